@@ -0,0 +1,500 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// awsCredentialsRefreshWindow is how long before their expiration
+	// temporary credentials are refreshed.
+	awsCredentialsRefreshWindow = 5 * time.Minute
+
+	// awsCredentialsRetryInterval is how long to wait before retrying after
+	// credentials couldn't be retrieved.
+	awsCredentialsRetryInterval = 30 * time.Second
+
+	awsContainerCredentialsHost  = "http://169.254.170.2"
+	awsInstanceMetadataEndpoint  = "http://169.254.169.254"
+	awsInstanceMetadataTokenTTL  = "21600"
+	awsCredentialsRequestTimeout = 5 * time.Second
+	awsInstanceMetadataTimeout   = 2 * time.Second
+)
+
+// AWSCredentialsProvider retrieves credentials used to sign requests to AWS.
+type AWSCredentialsProvider interface {
+	Retrieve() (*AWSCredentials, error)
+}
+
+// NewAWSCredentialsProviderWithConfig returns a credentials provider for the
+// source. If the source specifies an access key and secret key, they are
+// used. Otherwise credentials are looked up, in order, in the environment,
+// the shared credentials file, a web identity token, the container
+// credentials endpoint and the instance metadata service. Temporary
+// credentials are refreshed before they expire.
+func NewAWSCredentialsProviderWithConfig(config *SourceConfig) AWSCredentialsProvider {
+	if config.S3AccessKey != "" || config.S3SecretKey != "" {
+		return &staticAWSCredentialsProvider{AWSCredentials{
+			AccessKeyID:     config.S3AccessKey,
+			SecretAccessKey: config.S3SecretKey,
+		}}
+	}
+
+	profile := config.S3Profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	return &cachingAWSCredentialsProvider{
+		Logger: NewLogger("aws.credentials.%s", config.Name),
+		Provider: &chainAWSCredentialsProvider{Providers: []AWSCredentialsProvider{
+			&environmentAWSCredentialsProvider{},
+			&sharedFileAWSCredentialsProvider{Profile: profile},
+			&webIdentityAWSCredentialsProvider{Region: config.S3Region},
+			&containerAWSCredentialsProvider{},
+			&instanceMetadataAWSCredentialsProvider{},
+		}},
+	}
+}
+
+// staticAWSCredentialsProvider provides fixed credentials.
+type staticAWSCredentialsProvider struct {
+	Credentials AWSCredentials
+}
+
+func (p *staticAWSCredentialsProvider) Retrieve() (*AWSCredentials, error) {
+	return &p.Credentials, nil
+}
+
+// cachingAWSCredentialsProvider caches the credentials of another provider
+// until shortly before they expire. Only one caller refreshes the credentials
+// at a time. Other callers keep using the current credentials while they're
+// still valid, and otherwise wait for the refresh.
+type cachingAWSCredentialsProvider struct {
+	Provider AWSCredentialsProvider
+	Logger   *Logger
+
+	mutex       sync.Mutex
+	credentials *AWSCredentials
+	err         error
+	retryAt     time.Time
+	refreshing  chan struct{}
+}
+
+func (p *cachingAWSCredentialsProvider) Retrieve() (*AWSCredentials, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for {
+		now := time.Now()
+		if p.credentials != nil && !p.credentials.expiresBefore(now.Add(awsCredentialsRefreshWindow)) {
+			return p.credentials, nil
+		}
+
+		// Keep using the current credentials until they actually expire while
+		// they're being refreshed, or after refreshing them failed.
+		valid := p.credentials != nil && !p.credentials.expiresBefore(now)
+		if valid && (p.refreshing != nil || now.Before(p.retryAt)) {
+			return p.credentials, nil
+		}
+		if now.Before(p.retryAt) {
+			return nil, p.err
+		}
+		if p.refreshing == nil {
+			return p.refresh()
+		}
+
+		refreshing := p.refreshing
+		p.mutex.Unlock()
+		<-refreshing
+		p.mutex.Lock()
+	}
+}
+
+// refresh retrieves new credentials from the provider. The mutex must be held
+// by the caller, and is released while the credentials are retrieved.
+func (p *cachingAWSCredentialsProvider) refresh() (*AWSCredentials, error) {
+	refreshing := make(chan struct{})
+	p.refreshing = refreshing
+	p.mutex.Unlock()
+
+	credentials, err := p.Provider.Retrieve()
+
+	p.mutex.Lock()
+	p.refreshing = nil
+	close(refreshing)
+
+	now := time.Now()
+	if err != nil {
+		p.err = err
+		p.retryAt = now.Add(awsCredentialsRetryInterval)
+		if p.credentials != nil && !p.credentials.expiresBefore(now) {
+			p.Logger.Warnf("Unable to refresh credentials: %v", err)
+			return p.credentials, nil
+		}
+		p.Logger.Errorf("Unable to retrieve credentials: %v", err)
+		p.credentials = nil
+		return nil, err
+	}
+
+	if p.credentials == nil {
+		p.Logger.Infof("Retrieved credentials for access key %s", credentials.AccessKeyID)
+	}
+	p.credentials = credentials
+	p.err = nil
+	p.retryAt = time.Time{}
+	return credentials, nil
+}
+
+// chainAWSCredentialsProvider returns the credentials of the first provider
+// that's able to provide them. That provider is tried first for subsequent
+// retrievals, and the rest of the chain is tried again if it fails.
+type chainAWSCredentialsProvider struct {
+	Providers []AWSCredentialsProvider
+
+	current    int
+	hasCurrent bool
+}
+
+func (p *chainAWSCredentialsProvider) Retrieve() (*AWSCredentials, error) {
+	var messages []string
+	if p.hasCurrent {
+		credentials, err := p.Providers[p.current].Retrieve()
+		if err == nil {
+			return credentials, nil
+		}
+		messages = append(messages, err.Error())
+	}
+
+	for i, provider := range p.Providers {
+		if p.hasCurrent && i == p.current {
+			continue
+		}
+		credentials, err := provider.Retrieve()
+		if err == nil {
+			p.current, p.hasCurrent = i, true
+			return credentials, nil
+		}
+		messages = append(messages, err.Error())
+	}
+	p.hasCurrent = false
+	return nil, fmt.Errorf("no AWS credentials found: %s", strings.Join(messages, "; "))
+}
+
+// environmentAWSCredentialsProvider reads credentials from the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment
+// variables.
+type environmentAWSCredentialsProvider struct{}
+
+func (p *environmentAWSCredentialsProvider) Retrieve() (*AWSCredentials, error) {
+	credentials := &AWSCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return nil, errors.New("environment: AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY not set")
+	}
+	return credentials, nil
+}
+
+// sharedFileAWSCredentialsProvider reads credentials for a profile from the
+// shared credentials file, ~/.aws/credentials by default.
+type sharedFileAWSCredentialsProvider struct {
+	Filename string
+	Profile  string
+}
+
+func (p *sharedFileAWSCredentialsProvider) Retrieve() (*AWSCredentials, error) {
+	filename := p.Filename
+	if filename == "" {
+		filename = os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	}
+	if filename == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			home = os.Getenv("USERPROFILE")
+		}
+		filename = filepath.Join(home, ".aws", "credentials")
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("shared credentials file: %v", err)
+	}
+	defer file.Close()
+
+	values := make(map[string]string)
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(strings.TrimPrefix(line[1:len(line)-1], "profile "))
+		case section == p.Profile:
+			if i := strings.Index(line, "="); i != -1 {
+				values[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("shared credentials file: %v", err)
+	}
+
+	credentials := &AWSCredentials{
+		AccessKeyID:     values["aws_access_key_id"],
+		SecretAccessKey: values["aws_secret_access_key"],
+		SessionToken:    values["aws_session_token"],
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return nil, fmt.Errorf("shared credentials file: no credentials for profile %s in %s", p.Profile, filename)
+	}
+	return credentials, nil
+}
+
+// webIdentityAWSCredentialsProvider exchanges the web identity token in the
+// file named by AWS_WEB_IDENTITY_TOKEN_FILE for temporary credentials of the
+// role named by AWS_ROLE_ARN, as set up for Kubernetes service accounts.
+type webIdentityAWSCredentialsProvider struct {
+	Region   string
+	Endpoint string
+}
+
+func (p *webIdentityAWSCredentialsProvider) Retrieve() (*AWSCredentials, error) {
+	tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	roleARN := os.Getenv("AWS_ROLE_ARN")
+	if tokenFile == "" || roleARN == "" {
+		return nil, errors.New("web identity: AWS_WEB_IDENTITY_TOKEN_FILE or AWS_ROLE_ARN not set")
+	}
+
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("web identity: %v", err)
+	}
+
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("halfshell-%d", time.Now().UnixNano())
+	}
+
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://sts.%s.amazonaws.com", p.Region)
+	}
+
+	query := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	httpRequest, err := http.NewRequest("POST", endpoint, strings.NewReader(query.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("web identity: %v", err)
+	}
+	httpRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	body, err := awsCredentialsRequest(httpRequest, awsCredentialsRequestTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("web identity: %v", err)
+	}
+
+	var response struct {
+		Credentials struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("web identity: %v", err)
+	}
+
+	return &AWSCredentials{
+		AccessKeyID:     response.Credentials.AccessKeyId,
+		SecretAccessKey: response.Credentials.SecretAccessKey,
+		SessionToken:    response.Credentials.SessionToken,
+		Expiration:      response.Credentials.Expiration,
+	}, nil
+}
+
+// containerAWSCredentialsProvider retrieves credentials from the endpoint
+// named by AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or
+// AWS_CONTAINER_CREDENTIALS_FULL_URI, as set up for ECS tasks.
+type containerAWSCredentialsProvider struct{}
+
+func (p *containerAWSCredentialsProvider) Retrieve() (*AWSCredentials, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relativeURI := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relativeURI != "" {
+		endpoint = awsContainerCredentialsHost + relativeURI
+	}
+	if endpoint == "" {
+		return nil, errors.New("container: AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or AWS_CONTAINER_CREDENTIALS_FULL_URI not set")
+	}
+
+	httpRequest, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("container: %v", err)
+	}
+
+	authorization := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if tokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("container: %v", err)
+		}
+		authorization = strings.TrimSpace(string(token))
+	}
+	if authorization != "" {
+		httpRequest.Header.Set("Authorization", authorization)
+	}
+
+	body, err := awsCredentialsRequest(httpRequest, awsCredentialsRequestTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("container: %v", err)
+	}
+	credentials, err := awsCredentialsFromJSON(body)
+	if err != nil {
+		return nil, fmt.Errorf("container: %v", err)
+	}
+	return credentials, nil
+}
+
+// instanceMetadataAWSCredentialsProvider retrieves the credentials of the
+// instance's IAM role from the EC2 instance metadata service using IMDSv2.
+// The endpoint can be changed with AWS_EC2_METADATA_SERVICE_ENDPOINT.
+type instanceMetadataAWSCredentialsProvider struct{}
+
+func (p *instanceMetadataAWSCredentialsProvider) Retrieve() (*AWSCredentials, error) {
+	if strings.ToLower(os.Getenv("AWS_EC2_METADATA_DISABLED")) == "true" {
+		return nil, errors.New("instance metadata: AWS_EC2_METADATA_DISABLED is set")
+	}
+
+	endpoint := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = awsInstanceMetadataEndpoint
+	}
+	endpoint = strings.TrimRight(endpoint, "/")
+
+	tokenRequest, _ := http.NewRequest("PUT", endpoint+"/latest/api/token", nil)
+	tokenRequest.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", awsInstanceMetadataTokenTTL)
+	token, err := awsCredentialsRequest(tokenRequest, awsInstanceMetadataTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("instance metadata: %v", err)
+	}
+
+	metadataRequest := func(path string) ([]byte, error) {
+		httpRequest, err := http.NewRequest("GET", endpoint+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		httpRequest.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return awsCredentialsRequest(httpRequest, awsInstanceMetadataTimeout)
+	}
+
+	roles, err := metadataRequest("/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return nil, fmt.Errorf("instance metadata: %v", err)
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return nil, errors.New("instance metadata: no IAM role attached to instance")
+	}
+
+	body, err := metadataRequest("/latest/meta-data/iam/security-credentials/" + url.PathEscape(role))
+	if err != nil {
+		return nil, fmt.Errorf("instance metadata: %v", err)
+	}
+	credentials, err := awsCredentialsFromJSON(body)
+	if err != nil {
+		return nil, fmt.Errorf("instance metadata: %v", err)
+	}
+	return credentials, nil
+}
+
+// awsCredentialsRequest performs a request to a credentials endpoint and
+// returns the response body.
+func awsCredentialsRequest(httpRequest *http.Request, timeout time.Duration) ([]byte, error) {
+	client := &http.Client{Timeout: timeout}
+	httpResponse, err := client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	body, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, err
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s responded with status %d",
+			httpRequest.Method, httpRequest.URL, httpResponse.StatusCode)
+	}
+	return body, nil
+}
+
+// awsCredentialsFromJSON parses credentials in the format returned by the
+// container credentials endpoint and the instance metadata service.
+func awsCredentialsFromJSON(body []byte) (*AWSCredentials, error) {
+	var response struct {
+		Code            string
+		Message         string
+		AccessKeyId     string
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	if response.Code != "" && response.Code != "Success" {
+		return nil, fmt.Errorf("%s: %s", response.Code, response.Message)
+	}
+	if response.AccessKeyId == "" || response.SecretAccessKey == "" {
+		return nil, errors.New("response doesn't contain credentials")
+	}
+	return &AWSCredentials{
+		AccessKeyID:     response.AccessKeyId,
+		SecretAccessKey: response.SecretAccessKey,
+		SessionToken:    response.Token,
+		Expiration:      response.Expiration,
+	}, nil
+}
@@ -0,0 +1,358 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testAWSCredentialsJSON = `{
+  "Code": "Success",
+  "AccessKeyId": "ASIAEXAMPLE",
+  "SecretAccessKey": "secret",
+  "Token": "token",
+  "Expiration": "2030-01-01T00:00:00Z"
+}`
+
+// awsCredentialsProviderFunc adapts a function to an AWSCredentialsProvider.
+type awsCredentialsProviderFunc func() (*AWSCredentials, error)
+
+func (f awsCredentialsProviderFunc) Retrieve() (*AWSCredentials, error) {
+	return f()
+}
+
+func checkTestAWSCredentials(t *testing.T, credentials *AWSCredentials, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expiration := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	if credentials.AccessKeyID != "ASIAEXAMPLE" || credentials.SecretAccessKey != "secret" ||
+		credentials.SessionToken != "token" || !credentials.Expiration.Equal(expiration) {
+		t.Errorf("unexpected credentials: %+v", credentials)
+	}
+}
+
+func TestEnvironmentAWSCredentialsProvider(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "token")
+
+	provider := &environmentAWSCredentialsProvider{}
+	credentials, err := provider.Retrieve()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if credentials.AccessKeyID != "AKIAEXAMPLE" || credentials.SecretAccessKey != "secret" ||
+		credentials.SessionToken != "token" {
+		t.Errorf("unexpected credentials: %+v", credentials)
+	}
+
+	os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	if _, err := provider.Retrieve(); err == nil {
+		t.Error("expected error without AWS_SECRET_ACCESS_KEY")
+	}
+}
+
+func TestSharedFileAWSCredentialsProvider(t *testing.T) {
+	directory, err := ioutil.TempDir("", "halfshell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	filename := filepath.Join(directory, "credentials")
+	contents := `
+# Comment
+[default]
+aws_access_key_id = AKIADEFAULT
+aws_secret_access_key = default-secret
+
+[profile images]
+aws_access_key_id=AKIAIMAGES
+aws_secret_access_key=images-secret
+aws_session_token=images-token
+`
+	if err := ioutil.WriteFile(filename, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		profile      string
+		accessKeyID  string
+		sessionToken string
+	}{
+		{"default", "AKIADEFAULT", ""},
+		{"images", "AKIAIMAGES", "images-token"},
+	}
+	for _, test := range tests {
+		provider := &sharedFileAWSCredentialsProvider{Filename: filename, Profile: test.profile}
+		credentials, err := provider.Retrieve()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.profile, err)
+			continue
+		}
+		if credentials.AccessKeyID != test.accessKeyID || credentials.SessionToken != test.sessionToken {
+			t.Errorf("%s: unexpected credentials: %+v", test.profile, credentials)
+		}
+	}
+
+	provider := &sharedFileAWSCredentialsProvider{Filename: filename, Profile: "missing"}
+	if _, err := provider.Retrieve(); err == nil {
+		t.Error("expected error for missing profile")
+	}
+}
+
+func TestContainerAWSCredentialsProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/credentials" || r.Header.Get("Authorization") != "auth-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, testAWSCredentialsJSON)
+	}))
+	defer server.Close()
+
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", server.URL+"/credentials")
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "auth-token")
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE", "")
+
+	credentials, err := (&containerAWSCredentialsProvider{}).Retrieve()
+	checkTestAWSCredentials(t, credentials, err)
+
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "wrong-token")
+	if _, err := (&containerAWSCredentialsProvider{}).Retrieve(); err == nil {
+		t.Error("expected error for rejected authorization token")
+	}
+}
+
+func TestInstanceMetadataAWSCredentialsProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && r.URL.Path == "/latest/api/token" {
+			if r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, "session-token")
+			return
+		}
+		if r.Method != "GET" || r.Header.Get("X-aws-ec2-metadata-token") != "session-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			fmt.Fprint(w, "image-role\n")
+		case "/latest/meta-data/iam/security-credentials/image-role":
+			fmt.Fprint(w, testAWSCredentialsJSON)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "")
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", server.URL+"/")
+
+	credentials, err := (&instanceMetadataAWSCredentialsProvider{}).Retrieve()
+	checkTestAWSCredentials(t, credentials, err)
+
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	if _, err := (&instanceMetadataAWSCredentialsProvider{}).Retrieve(); err == nil {
+		t.Error("expected error with AWS_EC2_METADATA_DISABLED")
+	}
+}
+
+func TestChainAWSCredentialsProviderRetriesChainWhenProviderFails(t *testing.T) {
+	var calls []string
+	available := map[string]bool{"first": false, "second": true, "third": true}
+	newProvider := func(name string) AWSCredentialsProvider {
+		return awsCredentialsProviderFunc(func() (*AWSCredentials, error) {
+			calls = append(calls, name)
+			if !available[name] {
+				return nil, fmt.Errorf("%s unavailable", name)
+			}
+			return &AWSCredentials{AccessKeyID: name, SecretAccessKey: "secret"}, nil
+		})
+	}
+	provider := &chainAWSCredentialsProvider{Providers: []AWSCredentialsProvider{
+		newProvider("first"), newProvider("second"), newProvider("third"),
+	}}
+
+	retrieve := func(expected string, expectedCalls ...string) {
+		t.Helper()
+		calls = nil
+		credentials, err := provider.Retrieve()
+		if expected == "" {
+			if err == nil {
+				t.Errorf("expected error, got %+v", credentials)
+			}
+		} else if err != nil || credentials.AccessKeyID != expected {
+			t.Errorf("got %+v, %v, expected credentials from %s", credentials, err, expected)
+		}
+		if !reflect.DeepEqual(calls, expectedCalls) {
+			t.Errorf("got calls %v, expected %v", calls, expectedCalls)
+		}
+	}
+
+	retrieve("second", "first", "second")
+	retrieve("second", "second")
+
+	// The chain is walked again, in order, when the provider fails.
+	available["first"], available["second"] = true, false
+	retrieve("first", "second", "first")
+	retrieve("first", "first")
+
+	available["first"], available["second"], available["third"] = false, false, false
+	retrieve("", "first", "second", "third")
+	available["third"] = true
+	retrieve("third", "first", "second", "third")
+}
+
+func TestCachingAWSCredentialsProviderRefreshesBeforeExpiry(t *testing.T) {
+	var calls int
+	expiration := time.Now().Add(time.Hour)
+	provider := &cachingAWSCredentialsProvider{
+		Logger: NewLogger("aws.credentials.test"),
+		Provider: awsCredentialsProviderFunc(func() (*AWSCredentials, error) {
+			calls++
+			return &AWSCredentials{
+				AccessKeyID:     fmt.Sprintf("AKIA%d", calls),
+				SecretAccessKey: "secret",
+				Expiration:      expiration,
+			}, nil
+		}),
+	}
+
+	for i := 0; i < 3; i++ {
+		credentials, err := provider.Retrieve()
+		if err != nil || credentials.AccessKeyID != "AKIA1" {
+			t.Fatalf("unexpected credentials: %+v, %v", credentials, err)
+		}
+	}
+
+	// Credentials expiring within the refresh window are refreshed.
+	expiration = time.Now().Add(awsCredentialsRefreshWindow / 2)
+	provider.credentials.Expiration = expiration
+	credentials, err := provider.Retrieve()
+	if err != nil || credentials.AccessKeyID != "AKIA2" {
+		t.Fatalf("unexpected credentials: %+v, %v", credentials, err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 retrievals, got %d", calls)
+	}
+}
+
+func TestCachingAWSCredentialsProviderKeepsCredentialsWhenRefreshFails(t *testing.T) {
+	var calls int
+	provider := &cachingAWSCredentialsProvider{
+		Logger: NewLogger("aws.credentials.test"),
+		Provider: awsCredentialsProviderFunc(func() (*AWSCredentials, error) {
+			calls++
+			return nil, errors.New("unavailable")
+		}),
+		credentials: &AWSCredentials{
+			AccessKeyID:     "AKIAOLD",
+			SecretAccessKey: "secret",
+			Expiration:      time.Now().Add(time.Minute),
+		},
+	}
+
+	for i := 0; i < 3; i++ {
+		credentials, err := provider.Retrieve()
+		if err != nil || credentials.AccessKeyID != "AKIAOLD" {
+			t.Fatalf("unexpected credentials: %+v, %v", credentials, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected refresh to be retried after %v, got %d retrievals",
+			awsCredentialsRetryInterval, calls)
+	}
+}
+
+func TestCachingAWSCredentialsProviderDoesNotBlockDuringRefresh(t *testing.T) {
+	var mutex sync.Mutex
+	var calls int
+	started := make(chan struct{})
+	release := make(chan struct{})
+	provider := &cachingAWSCredentialsProvider{
+		Logger: NewLogger("aws.credentials.test"),
+		Provider: awsCredentialsProviderFunc(func() (*AWSCredentials, error) {
+			mutex.Lock()
+			calls++
+			mutex.Unlock()
+			close(started)
+			<-release
+			return &AWSCredentials{
+				AccessKeyID:     "AKIANEW",
+				SecretAccessKey: "secret",
+				Expiration:      time.Now().Add(time.Hour),
+			}, nil
+		}),
+		credentials: &AWSCredentials{
+			AccessKeyID:     "AKIAOLD",
+			SecretAccessKey: "secret",
+			Expiration:      time.Now().Add(time.Minute),
+		},
+	}
+
+	refreshed := make(chan *AWSCredentials)
+	go func() {
+		credentials, _ := provider.Retrieve()
+		refreshed <- credentials
+	}()
+	<-started
+
+	// While the refresh is in progress, other callers get the current
+	// credentials without waiting.
+	for i := 0; i < 3; i++ {
+		credentials, err := provider.Retrieve()
+		if err != nil || credentials.AccessKeyID != "AKIAOLD" {
+			t.Fatalf("unexpected credentials during refresh: %+v, %v", credentials, err)
+		}
+	}
+
+	close(release)
+	if credentials := <-refreshed; credentials.AccessKeyID != "AKIANEW" {
+		t.Fatalf("unexpected refreshed credentials: %+v", credentials)
+	}
+	credentials, err := provider.Retrieve()
+	if err != nil || credentials.AccessKeyID != "AKIANEW" {
+		t.Fatalf("unexpected credentials after refresh: %+v, %v", credentials, err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if calls != 1 {
+		t.Errorf("expected 1 retrieval, got %d", calls)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	awsSigningAlgorithm = "AWS4-HMAC-SHA256"
+	awsTimeFormat       = "20060102T150405Z"
+	awsDateFormat       = "20060102"
+
+	// awsEmptyPayloadHash is the SHA-256 hash of an empty request body.
+	awsEmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// AWSCredentials holds the keys used to sign requests to AWS.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Expiration is the time temporary credentials expire at. It is zero for
+	// credentials that don't expire.
+	Expiration time.Time
+}
+
+func (c *AWSCredentials) expiresBefore(t time.Time) bool {
+	return !c.Expiration.IsZero() && c.Expiration.Before(t)
+}
+
+// signAWSRequestV4 signs an HTTP request without a body for the given AWS
+// region and service using AWS Signature Version 4. The escaped path of the
+// request's URL is signed as is, so it should be escaped with awsURIEscape.
+// The host and all headers set on the request are signed.
+func signAWSRequestV4(request *http.Request, credentials *AWSCredentials,
+	region, service string, now time.Time) {
+
+	now = now.UTC()
+	request.Header.Set("X-Amz-Date", now.Format(awsTimeFormat))
+	request.Header.Set("X-Amz-Content-Sha256", awsEmptyPayloadHash)
+	if credentials.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	canonicalHeaders, signedHeaders := awsCanonicalHeaders(request)
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		awsCanonicalURI(request),
+		awsCanonicalQueryString(request),
+		canonicalHeaders,
+		signedHeaders,
+		awsEmptyPayloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format(awsDateFormat), region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		awsSigningAlgorithm,
+		now.Format(awsTimeFormat),
+		scope,
+		hex.EncodeToString(awsSHA256([]byte(canonicalRequest))),
+	}, "\n")
+
+	key := awsHMAC([]byte("AWS4"+credentials.SecretAccessKey), now.Format(awsDateFormat))
+	key = awsHMAC(key, region)
+	key = awsHMAC(key, service)
+	key = awsHMAC(key, "aws4_request")
+	signature := hex.EncodeToString(awsHMAC(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSigningAlgorithm, credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// awsCanonicalURI returns the escaped path of the request.
+func awsCanonicalURI(request *http.Request) string {
+	path := request.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return path
+}
+
+// awsCanonicalQueryString returns the query parameters of the request, sorted
+// by name and value.
+func awsCanonicalQueryString(request *http.Request) string {
+	var parameters []string
+	for name, values := range request.URL.Query() {
+		for _, value := range values {
+			parameters = append(parameters, awsURIEscape(name, true)+"="+awsURIEscape(value, true))
+		}
+	}
+	sort.Strings(parameters)
+	return strings.Join(parameters, "&")
+}
+
+// awsCanonicalHeaders returns the canonical headers block and the list of
+// signed header names for the request.
+func awsCanonicalHeaders(request *http.Request) (string, string) {
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		name = strings.ToLower(name)
+		if name == "authorization" {
+			continue
+		}
+		trimmedValues := make([]string, len(values))
+		for i, value := range values {
+			trimmedValues[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[name] = strings.Join(trimmedValues, ",")
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders []string
+	for _, name := range names {
+		canonicalHeaders = append(canonicalHeaders, name+":"+headers[name]+"\n")
+	}
+	return strings.Join(canonicalHeaders, ""), strings.Join(names, ";")
+}
+
+// awsURIEscape percent-encodes every byte of s except the unreserved
+// characters, as required by AWS Signature Version 4. Slashes are left
+// unescaped unless encodeSlash is set.
+func awsURIEscape(s string, encodeSlash bool) string {
+	var escaped []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			escaped = append(escaped, c)
+		case c == '/' && !encodeSlash:
+			escaped = append(escaped, c)
+		default:
+			escaped = append(escaped, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(escaped)
+}
+
+func awsSHA256(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+func awsHMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
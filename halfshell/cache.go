@@ -0,0 +1,44 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+// ImageCache stores processed images by their cache key.
+type ImageCache interface {
+	Get(key string) (*EncodedImage, bool)
+	Set(key string, image *EncodedImage)
+}
+
+// NewImageCachesWithConfig returns the caches configured for a route, in the
+// order in which they should be consulted.
+func NewImageCachesWithConfig(config *RouteConfig, statter Statter) ([]ImageCache, error) {
+	var caches []ImageCache
+	if config.MemoryCacheSize > 0 {
+		caches = append(caches, NewMemoryImageCache(config.MemoryCacheSize, statter))
+	}
+	if config.DiskCacheConfig != nil {
+		diskCache, err := NewDiskImageCacheWithConfig(config.DiskCacheConfig, config.Name, statter)
+		if err != nil {
+			return nil, err
+		}
+		caches = append(caches, diskCache)
+	}
+	return caches, nil
+}
@@ -0,0 +1,302 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const diskImageCacheTempPrefix = ".halfshell-tmp-"
+
+var errDiskImageCacheExpired = errors.New("cached image expired")
+
+// diskImageCacheFileNamePattern and diskImageCacheTempFileNamePattern match the
+// names of the cache files and of the temporary files they're written to.
+// Other files in the directory are left alone.
+var (
+	diskImageCacheFileNamePattern     = regexp.MustCompile(`^[0-9a-f]{40}$`)
+	diskImageCacheTempFileNamePattern = regexp.MustCompile(
+		`^` + regexp.QuoteMeta(diskImageCacheTempPrefix) + `[0-9]+$`)
+)
+
+// DiskImageCache is an ImageCache that persists images in a directory so that
+// they survive restarts. Images are evicted once they are older than the
+// configured TTL, or when the total size of the cached images exceeds the
+// configured maximum size, least recently used first.
+type DiskImageCache struct {
+	Config  *DiskCacheConfig
+	Statter Statter
+	Logger  *Logger
+
+	mutex    sync.Mutex
+	size     uint64
+	entries  *list.List
+	elements map[string]*list.Element
+}
+
+type diskImageCacheEntry struct {
+	name string
+	size uint64
+}
+
+// diskImageCacheHeader is stored as a line of JSON preceding the image data in
+// each cache file.
+type diskImageCacheHeader struct {
+	Key          string
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+	Created      time.Time
+}
+
+// NewDiskImageCacheWithConfig creates a DiskImageCache in the configured
+// directory, indexing any images cached by previous processes and removing
+// their leftover temporary files. An error is returned if the directory can't
+// be created or read.
+func NewDiskImageCacheWithConfig(config *DiskCacheConfig, name string, statter Statter) (*DiskImageCache, error) {
+	cache := &DiskImageCache{
+		Config:   config,
+		Statter:  statter,
+		Logger:   NewLogger("cache.disk.%s", name),
+		entries:  list.New(),
+		elements: make(map[string]*list.Element),
+	}
+
+	err := os.MkdirAll(config.Directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfos, err := ioutil.ReadDir(config.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files are indexed from least to most recently used. The modification
+	// time of a file is updated whenever it is read.
+	sort.Sort(byModTime(fileInfos))
+	for _, fileInfo := range fileInfos {
+		if !fileInfo.Mode().IsRegular() {
+			continue
+		}
+		switch {
+		case diskImageCacheTempFileNamePattern.MatchString(fileInfo.Name()):
+			os.Remove(filepath.Join(config.Directory, fileInfo.Name()))
+		case diskImageCacheFileNamePattern.MatchString(fileInfo.Name()):
+			cache.add(fileInfo.Name(), uint64(fileInfo.Size()))
+		}
+	}
+	cache.evict()
+
+	cache.Logger.Infof("Indexed %d cached images (%d bytes) in %s",
+		cache.entries.Len(), cache.size, config.Directory)
+
+	return cache, nil
+}
+
+// Get returns the cached image for the key and marks it as recently used.
+func (c *DiskImageCache) Get(key string) (*EncodedImage, bool) {
+	name := c.fileNameForKey(key)
+
+	c.mutex.Lock()
+	element, ok := c.elements[name]
+	if ok {
+		c.entries.MoveToFront(element)
+	}
+	c.mutex.Unlock()
+
+	if !ok {
+		c.Statter.Increment("cache.disk.miss")
+		return nil, false
+	}
+
+	image, err := c.read(name, key)
+	if err != nil {
+		if err != errDiskImageCacheExpired {
+			c.Logger.Warnf("Unable to read cached image %s: %v", name, err)
+		}
+		c.Statter.Increment("cache.disk.miss")
+		c.mutex.Lock()
+		c.removeFile(name)
+		c.mutex.Unlock()
+		return nil, false
+	}
+
+	now := time.Now()
+	os.Chtimes(filepath.Join(c.Config.Directory, name), now, now)
+
+	c.Statter.Increment("cache.disk.hit")
+	return image, true
+}
+
+// Set writes the image for the key to disk, evicting the least recently used
+// images as needed. Images larger than the maximum size of the cache aren't
+// stored.
+func (c *DiskImageCache) Set(key string, image *EncodedImage) {
+	name := c.fileNameForKey(key)
+
+	size, err := c.write(name, key, image)
+	if err != nil {
+		c.Logger.Warnf("Unable to write cached image %s: %v", name, err)
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.elements[name]; ok {
+		c.remove(element)
+	}
+	c.add(name, size)
+	c.evict()
+}
+
+func (c *DiskImageCache) read(name, key string) (*EncodedImage, error) {
+	file, err := os.Open(filepath.Join(c.Config.Directory, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	headerBytes, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	var header diskImageCacheHeader
+	err = json.Unmarshal(headerBytes, &header)
+	if err != nil {
+		return nil, err
+	}
+	if header.Key != key {
+		return nil, fmt.Errorf("cached image has key %s", header.Key)
+	}
+
+	ttl := time.Duration(c.Config.TTL) * time.Second
+	if ttl > 0 && time.Since(header.Created) > ttl {
+		return nil, errDiskImageCacheExpired
+	}
+
+	bytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncodedImage{
+		Bytes:        bytes,
+		ContentType:  header.ContentType,
+		ETag:         header.ETag,
+		LastModified: header.LastModified,
+	}, nil
+}
+
+// write writes the image to a temporary file which is then renamed, so that
+// readers never observe partially written files.
+func (c *DiskImageCache) write(name, key string, image *EncodedImage) (uint64, error) {
+	headerBytes, err := json.Marshal(diskImageCacheHeader{
+		Key:          key,
+		ContentType:  image.ContentType,
+		ETag:         image.ETag,
+		LastModified: image.LastModified,
+		Created:      time.Now(),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	size := uint64(len(headerBytes) + 1 + len(image.Bytes))
+	if size > c.Config.MaxSize {
+		return 0, fmt.Errorf("image size %d exceeds cache size %d", size, c.Config.MaxSize)
+	}
+
+	file, err := ioutil.TempFile(c.Config.Directory, diskImageCacheTempPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = file.Write(append(headerBytes, '\n'))
+	if err == nil {
+		_, err = file.Write(image.Bytes)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(c.Config.Directory, name))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return 0, err
+	}
+
+	return size, nil
+}
+
+func (c *DiskImageCache) add(name string, size uint64) {
+	entry := &diskImageCacheEntry{name: name, size: size}
+	c.elements[name] = c.entries.PushFront(entry)
+	c.size += size
+}
+
+func (c *DiskImageCache) evict() {
+	for c.size > c.Config.MaxSize {
+		element := c.entries.Back()
+		name := element.Value.(*diskImageCacheEntry).name
+		c.remove(element)
+		os.Remove(filepath.Join(c.Config.Directory, name))
+	}
+}
+
+func (c *DiskImageCache) remove(element *list.Element) {
+	entry := c.entries.Remove(element).(*diskImageCacheEntry)
+	delete(c.elements, entry.name)
+	c.size -= entry.size
+}
+
+func (c *DiskImageCache) removeFile(name string) {
+	if element, ok := c.elements[name]; ok {
+		c.remove(element)
+	}
+	os.Remove(filepath.Join(c.Config.Directory, name))
+}
+
+func (c *DiskImageCache) fileNameForKey(key string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key)))
+}
+
+type byModTime []os.FileInfo
+
+func (f byModTime) Len() int           { return len(f) }
+func (f byModTime) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f byModTime) Less(i, j int) bool { return f[i].ModTime().Before(f[j].ModTime()) }
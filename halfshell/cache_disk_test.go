@@ -0,0 +1,51 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewDiskImageCacheWithConfigReturnsDirectoryErrors(t *testing.T) {
+	root, err := ioutil.TempDir("", "halfshell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	file := filepath.Join(root, "file")
+	if err := ioutil.WriteFile(file, []byte("file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &DiskCacheConfig{Directory: filepath.Join(file, "cache"), MaxSize: 1 << 20}
+	if _, err := NewDiskImageCacheWithConfig(config, "test", nil); err == nil {
+		t.Errorf("expected an error for a directory that can't be created")
+	}
+
+	config = &DiskCacheConfig{Directory: filepath.Join(root, "cache"), MaxSize: 1 << 20}
+	if _, err := NewDiskImageCacheWithConfig(config, "test", nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
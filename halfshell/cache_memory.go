@@ -0,0 +1,102 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"container/list"
+	"sync"
+)
+
+// MemoryImageCache is an in-memory ImageCache that evicts the least recently
+// used images once the total size of the cached images exceeds its maximum
+// size in bytes.
+type MemoryImageCache struct {
+	MaxSize uint64
+	Statter Statter
+
+	mutex    sync.Mutex
+	size     uint64
+	entries  *list.List
+	elements map[string]*list.Element
+}
+
+type memoryImageCacheEntry struct {
+	key   string
+	image *EncodedImage
+	size  uint64
+}
+
+// NewMemoryImageCache creates a new MemoryImageCache holding at most maxSize
+// bytes of images.
+func NewMemoryImageCache(maxSize uint64, statter Statter) *MemoryImageCache {
+	return &MemoryImageCache{
+		MaxSize:  maxSize,
+		Statter:  statter,
+		entries:  list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached image for the key and marks it as recently used.
+func (c *MemoryImageCache) Get(key string) (*EncodedImage, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.elements[key]
+	if !ok {
+		c.Statter.Increment("cache.memory.miss")
+		return nil, false
+	}
+
+	c.Statter.Increment("cache.memory.hit")
+	c.entries.MoveToFront(element)
+	return element.Value.(*memoryImageCacheEntry).image, true
+}
+
+// Set stores the image for the key, evicting the least recently used images
+// as needed. Images larger than the maximum size of the cache aren't stored.
+func (c *MemoryImageCache) Set(key string, image *EncodedImage) {
+	size := uint64(len(key) + len(image.Bytes))
+	if size > c.MaxSize {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.elements[key]; ok {
+		c.remove(element)
+	}
+
+	entry := &memoryImageCacheEntry{key: key, image: image, size: size}
+	c.elements[key] = c.entries.PushFront(entry)
+	c.size += size
+
+	for c.size > c.MaxSize {
+		c.remove(c.entries.Back())
+	}
+}
+
+func (c *MemoryImageCache) remove(element *list.Element) {
+	entry := c.entries.Remove(element).(*memoryImageCacheEntry)
+	delete(c.elements, entry.key)
+	c.size -= entry.size
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"errors"
+	"sync"
+)
+
+var errFlightIncomplete = errors.New("coalesced call did not complete")
+
+// flightGroup coalesces concurrent calls that share a key into a single call
+// whose result is shared by all callers. The zero value is ready to use.
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg      sync.WaitGroup
+	value   interface{}
+	err     error
+	callers int
+}
+
+// Do calls fn unless a call with the same key is already in flight, in which
+// case it waits for that call to complete instead. Each caller receives the
+// same value and error, along with the number of callers that shared them.
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, int, error) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		call.callers++
+		g.mutex.Unlock()
+		call.wg.Wait()
+		return call.value, call.callers, call.err
+	}
+	call := &flightCall{callers: 1, err: errFlightIncomplete}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mutex.Unlock()
+
+	func() {
+		// Once the call is removed from the group no more callers can join it,
+		// so the number of callers is final.
+		defer func() {
+			g.mutex.Lock()
+			delete(g.calls, key)
+			g.mutex.Unlock()
+			call.wg.Done()
+		}()
+		call.value, call.err = fn()
+	}()
+
+	return call.value, call.callers, call.err
+}
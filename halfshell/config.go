@@ -26,15 +26,18 @@ import (
 	"os"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 )
 
 // Config is the primary configuration of Halfshell. It contains the server
-// configuration as well as a list of route configurations.
+// configuration as well as a list of route configurations, in the order in
+// which routes are matched.
 type Config struct {
-	ServerConfig  *ServerConfig
-	StatterConfig *StatterConfig
-	RouteConfigs  []*RouteConfig
+	ServerConfig         *ServerConfig
+	StatterConfig        *StatterConfig
+	ResourceLimitsConfig *ResourceLimitsConfig
+	RouteConfigs         []*RouteConfig
 }
 
 // ServerConfig holds the configuration settings relevant for the HTTP server.
@@ -42,16 +45,43 @@ type ServerConfig struct {
 	Port         uint64
 	ReadTimeout  uint64
 	WriteTimeout uint64
+	JSONErrors   bool
+}
+
+// ResourceLimitsConfig holds the ImageMagick resource limits, which apply to
+// all processing. A limit of 0 leaves ImageMagick's default in place.
+type ResourceLimitsConfig struct {
+	Memory  uint64
+	Map     uint64
+	Disk    uint64
+	Area    uint64
+	Threads uint64
+	Time    uint64
 }
 
 // RouteConfig holds the configuration settings for a particular route.
 type RouteConfig struct {
-	Name            string
-	CacheControl    string
-	Pattern         *regexp.Regexp
-	ImagePathIndex  int
-	SourceConfig    *SourceConfig
-	ProcessorConfig *ProcessorConfig
+	Name                 string
+	CacheControl         string
+	MemoryCacheSize      uint64
+	DiskCacheConfig      *DiskCacheConfig
+	SigningKeys          []string
+	Pattern              *regexp.Regexp
+	Host                 string
+	ImagePathIndex       int
+	OptionsSyntax        string
+	SourceConfig         *SourceConfig
+	ProcessorConfig      *ProcessorConfig
+	Fallback             string
+	FallbackSourceConfig *SourceConfig
+}
+
+// DiskCacheConfig holds the configuration settings for a route's on-disk cache
+// of processed images.
+type DiskCacheConfig struct {
+	Directory string
+	MaxSize   uint64
+	TTL       uint64
 }
 
 // SourceConfig holds the type information and configuration settings for a
@@ -62,21 +92,73 @@ type SourceConfig struct {
 	S3AccessKey string
 	S3Bucket    string
 	S3SecretKey string
+	S3Profile   string
+	S3Region    string
+	S3Endpoint  string
+	S3PathStyle bool
 	Directory   string
+	Layout      string
 	Host        string
+
+	FocalpointMetadata bool
+	FocalpointHeader   string
+
+	// Timeouts and backoffs are in seconds. A timeout of zero disables it.
+	ConnectTimeout            float64
+	ResponseTimeout           float64
+	IdleConnectionTimeout     float64
+	MaxIdleConnectionsPerHost uint64
+	MaxConnectionsPerHost     uint64
+	DisableKeepAlives         bool
+	MaxRetries                uint64
+	RetryBackoff              float64
+	RetryMaxBackoff           float64
+
+	MaxSourceBytes      uint64
+	AllowedContentTypes []string
+
+	RemoteURLs           bool
+	AllowedHosts         []string
+	AllowedSchemes       []string
+	MaxRedirects         uint64
+	AllowPrivateNetworks bool
+
+	CircuitBreakerConfig *CircuitBreakerConfig
+
+	ChainSourceNames   []string
+	ChainSourceConfigs []*SourceConfig
+	ChainFallthrough   []ImageErrorKind
+}
+
+// CircuitBreakerConfig holds the configuration settings for the circuit
+// breaker of an image source.
+type CircuitBreakerConfig struct {
+	ErrorRate     float64
+	MinRequests   uint64
+	Window        float64
+	Cooldown      float64
+	StatterConfig *StatterConfig
 }
 
 // ProcessorConfig holds the configuration settings for the image processor.
 type ProcessorConfig struct {
 	Name                    string
 	ImageCompressionQuality uint64
+	MinQuality              uint64
+	MaxQuality              uint64
 	DefaultScaleMode        uint
 	DefaultImageHeight      uint64
 	DefaultImageWidth       uint64
+	DefaultBackgroundColor  string
 	MaxImageDimensions      ImageDimensions
+	MaxInputPixels          uint64
+	MaxInputWidth           uint64
+	MaxInputHeight          uint64
 	MaxBlurRadiusPercentage float64
 	AutoOrient              bool
 	Formats                 map[string]FormatConfig
+	OutputFormats           []string
+	AutoFormat              bool
 
 	// DEPRECATED
 	MaintainAspectRatio bool
@@ -122,8 +204,9 @@ func newConfigParser(filepath string) *configParser {
 
 func (c *configParser) parse() *Config {
 	config := Config{
-		ServerConfig:  c.parseServerConfig(),
-		StatterConfig: c.parseStatterConfig(),
+		ServerConfig:         c.parseServerConfig(),
+		StatterConfig:        c.parseStatterConfig(),
+		ResourceLimitsConfig: c.parseResourceLimitsConfig(),
 	}
 
 	sourceConfigsByName := make(map[string]*SourceConfig)
@@ -132,47 +215,146 @@ func (c *configParser) parse() *Config {
 	for sourceName := range c.data["sources"].(map[string]interface{}) {
 		sourceConfigsByName[sourceName] = c.parseSourceConfig(sourceName)
 	}
+	resolveChainSourceConfigs(sourceConfigsByName)
 
 	for processorName := range c.data["processors"].(map[string]interface{}) {
 		processorConfigsByName[processorName] = c.parseProcessorConfig(processorName)
 	}
 
-	routesData := c.data["routes"].(map[string]interface{})
-	for routePatternString := range routesData {
-		routeConfig := &RouteConfig{ImagePathIndex: -1}
-		routeData := routesData[routePatternString].(map[string]interface{})
-		pattern, err := regexp.Compile(routePatternString)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Invalid route pattern %s: %v\n", routePatternString, err)
-			os.Exit(1)
+	// Routes are matched in the order they are listed. Routes given as a
+	// mapping of patterns to route configurations are ordered by pattern.
+	switch routesData := c.data["routes"].(type) {
+	case []interface{}:
+		for i, value := range routesData {
+			routeData, ok := value.(map[string]interface{})
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Invalid route %d: expected an object\n", i)
+				os.Exit(1)
+			}
+			routePatternString, _ := routeData["pattern"].(string)
+			config.RouteConfigs = append(config.RouteConfigs,
+				parseRouteConfig(routePatternString, routeData, sourceConfigsByName, processorConfigsByName))
 		}
-
-		for i, expName := range pattern.SubexpNames() {
-			if expName == "image_path" {
-				routeConfig.ImagePathIndex = i
+	case map[string]interface{}:
+		routePatternStrings := make([]string, 0, len(routesData))
+		for routePatternString := range routesData {
+			routePatternStrings = append(routePatternStrings, routePatternString)
+		}
+		sort.Strings(routePatternStrings)
+		for _, routePatternString := range routePatternStrings {
+			routeData, ok := routesData[routePatternString].(map[string]interface{})
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Invalid route %s: expected an object\n", routePatternString)
+				os.Exit(1)
 			}
+			config.RouteConfigs = append(config.RouteConfigs,
+				parseRouteConfig(routePatternString, routeData, sourceConfigsByName, processorConfigsByName))
 		}
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid or missing routes: expected a list of routes\n")
+		os.Exit(1)
+	}
 
-		if routeConfig.ImagePathIndex == -1 {
-			fmt.Fprintf(os.Stderr, "No 'image_path' named group in regex: %s\n", routePatternString)
-			os.Exit(1)
+	return &config
+}
+
+func parseRouteConfig(routePatternString string, routeData map[string]interface{},
+	sourceConfigsByName map[string]*SourceConfig,
+	processorConfigsByName map[string]*ProcessorConfig) *RouteConfig {
+
+	routeConfig := &RouteConfig{ImagePathIndex: -1}
+	pattern, err := regexp.Compile(routePatternString)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid route pattern %s: %v\n", routePatternString, err)
+		os.Exit(1)
+	}
+
+	for i, expName := range pattern.SubexpNames() {
+		if expName == "image_path" {
+			routeConfig.ImagePathIndex = i
 		}
+	}
+
+	if routeConfig.ImagePathIndex == -1 {
+		fmt.Fprintf(os.Stderr, "No 'image_path' named group in regex: %s\n", routePatternString)
+		os.Exit(1)
+	}
 
-		processorKey := routeData["processor"].(string)
-		sourceKey := routeData["source"].(string)
+	processorKey := routeData["processor"].(string)
+	sourceKey := routeData["source"].(string)
 
-		routeConfig.Name = routeData["name"].(string)
-		routeConfig.Pattern = pattern
-		routeConfig.ProcessorConfig = processorConfigsByName[processorKey]
-		routeConfig.SourceConfig = sourceConfigsByName[sourceKey]
-		if _, ok := routeData["cache_control"]; ok {
-			routeConfig.CacheControl = routeData["cache_control"].(string)
+	routeConfig.Name = routeData["name"].(string)
+	routeConfig.Pattern = pattern
+	routeConfig.ProcessorConfig = processorConfigsByName[processorKey]
+	routeConfig.SourceConfig = sourceConfigsByName[sourceKey]
+	if _, ok := routeData["host"]; ok {
+		routeConfig.Host = strings.ToLower(routeData["host"].(string))
+	}
+	if _, ok := routeData["cache_control"]; ok {
+		routeConfig.CacheControl = routeData["cache_control"].(string)
+	}
+	if memoryCacheSize, ok := routeData["memory_cache_size"].(float64); ok {
+		routeConfig.MemoryCacheSize = uint64(memoryCacheSize)
+	}
+	if diskCacheData, ok := routeData["disk_cache"].(map[string]interface{}); ok {
+		routeConfig.DiskCacheConfig = parseDiskCacheConfig(diskCacheData)
+	}
+	routeConfig.OptionsSyntax = OptionsSyntaxQuery
+	if optionsSyntax, ok := routeData["options_syntax"].(string); ok {
+		if optionsSyntax != OptionsSyntaxQuery && optionsSyntax != OptionsSyntaxPath {
+			fmt.Fprintf(os.Stderr, "Invalid options syntax %s for route %s\n", optionsSyntax, routeConfig.Name)
+			os.Exit(1)
+		}
+		routeConfig.OptionsSyntax = optionsSyntax
+	}
+	if fallback, ok := routeData["fallback"].(string); ok {
+		routeConfig.Fallback = fallback
+		routeConfig.FallbackSourceConfig = routeConfig.SourceConfig
+	}
+	if fallbackSourceKey, ok := routeData["fallback_source"].(string); ok {
+		if routeConfig.Fallback == "" {
+			fmt.Fprintf(os.Stderr, "No fallback specified for fallback source of route %s\n", routeConfig.Name)
+			os.Exit(1)
+		}
+		routeConfig.FallbackSourceConfig = sourceConfigsByName[fallbackSourceKey]
+		if routeConfig.FallbackSourceConfig == nil {
+			fmt.Fprintf(os.Stderr, "Invalid fallback source %s for route %s\n", fallbackSourceKey, routeConfig.Name)
+			os.Exit(1)
+		}
+	}
+	if signingKeys, ok := routeData["signing_keys"].([]interface{}); ok {
+		for _, value := range signingKeys {
+			signingKey, ok := value.(string)
+			if !ok || signingKey == "" {
+				fmt.Fprintf(os.Stderr, "Invalid signing key for route %s: expected a non-empty string\n", routeConfig.Name)
+				os.Exit(1)
+			}
+			routeConfig.SigningKeys = append(routeConfig.SigningKeys, signingKey)
 		}
+	}
 
-		config.RouteConfigs = append(config.RouteConfigs, routeConfig)
+	return routeConfig
+}
+
+func parseDiskCacheConfig(data map[string]interface{}) *DiskCacheConfig {
+	directory, _ := data["directory"].(string)
+	if directory == "" {
+		fmt.Fprintf(os.Stderr, "No directory specified for disk cache\n")
+		os.Exit(1)
 	}
 
-	return &config
+	maxSize, _ := data["max_size"].(float64)
+	if maxSize < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid max_size %v for disk cache %s\n", data["max_size"], directory)
+		os.Exit(1)
+	}
+	ttl, _ := data["ttl"].(float64)
+
+	return &DiskCacheConfig{
+		Directory: directory,
+		MaxSize:   uint64(maxSize),
+		TTL:       uint64(ttl),
+	}
 }
 
 func (c *configParser) parseServerConfig() *ServerConfig {
@@ -180,6 +362,7 @@ func (c *configParser) parseServerConfig() *ServerConfig {
 		Port:         c.uintForKeypath("server.port"),
 		ReadTimeout:  c.uintForKeypath("server.read_timeout"),
 		WriteTimeout: c.uintForKeypath("server.write_timeout"),
+		JSONErrors:   c.boolForKeypath("server.json_errors"),
 	}
 }
 
@@ -210,15 +393,188 @@ func (c *configParser) parseStatterConfig() *StatterConfig {
 	}
 }
 
+func (c *configParser) parseResourceLimitsConfig() *ResourceLimitsConfig {
+	limits, _ := c.data["resource_limits"].(map[string]interface{})
+
+	memory, _ := limits["memory"].(float64)
+	mapLimit, _ := limits["map"].(float64)
+	disk, _ := limits["disk"].(float64)
+	area, _ := limits["area"].(float64)
+	threads, _ := limits["threads"].(float64)
+	timeLimit, _ := limits["time"].(float64)
+
+	return &ResourceLimitsConfig{
+		Memory:  uint64(memory),
+		Map:     uint64(mapLimit),
+		Disk:    uint64(disk),
+		Area:    uint64(area),
+		Threads: uint64(threads),
+		Time:    uint64(timeLimit),
+	}
+}
+
 func (c *configParser) parseSourceConfig(sourceName string) *SourceConfig {
+	s3Region := c.stringForKeypath("sources.%s.s3_region", sourceName)
+	if s3Region == "" {
+		s3Region = DefaultS3Region
+	}
+
+	layout := c.stringForKeypath("sources.%s.layout", sourceName)
+	if layout == "" {
+		layout = FileSystemLayoutFlat
+	} else if layout != FileSystemLayoutFlat && layout != FileSystemLayoutTree {
+		fmt.Fprintf(os.Stderr, "Invalid layout %s for source %s\n", layout, sourceName)
+		os.Exit(1)
+	}
+
+	focalpointHeader := c.stringForKeypath("sources.%s.focalpoint_header", sourceName)
+	if focalpointHeader == "" {
+		focalpointHeader = DefaultFocalpointHeader
+	}
+
 	return &SourceConfig{
 		Name:        sourceName,
 		Type:        ImageSourceType(c.stringForKeypath("sources.%s.type", sourceName)),
 		S3AccessKey: c.stringForKeypath("sources.%s.s3_access_key", sourceName),
 		S3SecretKey: c.stringForKeypath("sources.%s.s3_secret_key", sourceName),
 		S3Bucket:    c.stringForKeypath("sources.%s.s3_bucket", sourceName),
+		S3Profile:   c.stringForKeypath("sources.%s.s3_profile", sourceName),
+		S3Region:    s3Region,
+		S3Endpoint:  c.stringForKeypath("sources.%s.s3_endpoint", sourceName),
+		S3PathStyle: c.boolForKeypath("sources.%s.s3_path_style", sourceName),
 		Directory:   c.stringForKeypath("sources.%s.directory", sourceName),
+		Layout:      layout,
 		Host:        c.stringForKeypath("sources.%s.host", sourceName),
+
+		FocalpointMetadata: c.boolForKeypath("sources.%s.focalpoint_metadata", sourceName),
+		FocalpointHeader:   focalpointHeader,
+
+		ConnectTimeout:            c.secondsForKeypath(DefaultConnectTimeout, "sources.%s.connect_timeout", sourceName),
+		ResponseTimeout:           c.secondsForKeypath(DefaultResponseTimeout, "sources.%s.response_timeout", sourceName),
+		IdleConnectionTimeout:     c.secondsForKeypath(DefaultIdleConnectionTimeout, "sources.%s.idle_connection_timeout", sourceName),
+		MaxIdleConnectionsPerHost: c.uintForKeypath("sources.%s.max_idle_connections_per_host", sourceName),
+		MaxConnectionsPerHost:     c.uintForKeypath("sources.%s.max_connections_per_host", sourceName),
+		DisableKeepAlives:         c.boolForKeypath("sources.%s.disable_keep_alives", sourceName),
+		MaxRetries:                c.uintForKeypath("sources.%s.max_retries", sourceName),
+		RetryBackoff:              c.secondsForKeypath(DefaultRetryBackoff, "sources.%s.retry_backoff", sourceName),
+		RetryMaxBackoff:           c.secondsForKeypath(DefaultRetryMaxBackoff, "sources.%s.retry_max_backoff", sourceName),
+
+		MaxSourceBytes:      c.uintForKeypath("sources.%s.max_source_bytes", sourceName),
+		AllowedContentTypes: c.stringsForKeypath("sources.%s.allowed_content_types", sourceName),
+
+		RemoteURLs:           c.boolForKeypath("sources.%s.remote_urls", sourceName),
+		AllowedHosts:         c.stringsForKeypath("sources.%s.allowed_hosts", sourceName),
+		AllowedSchemes:       c.stringsForKeypath("sources.%s.allowed_schemes", sourceName),
+		MaxRedirects:         c.uintForKeypath("sources.%s.max_redirects", sourceName),
+		AllowPrivateNetworks: c.boolForKeypath("sources.%s.allow_private_networks", sourceName),
+
+		CircuitBreakerConfig: c.parseCircuitBreakerConfig(sourceName),
+
+		ChainSourceNames: c.stringsForKeypath("sources.%s.sources", sourceName),
+		ChainFallthrough: c.parseChainFallthrough(sourceName),
+	}
+}
+
+func (c *configParser) parseCircuitBreakerConfig(sourceName string) *CircuitBreakerConfig {
+	sources := c.data["sources"].(map[string]interface{})
+	sourceData, _ := sources[sourceName].(map[string]interface{})
+	data, ok := sourceData["circuit_breaker"].(map[string]interface{})
+	if !ok {
+		defaultData, _ := sources["default"].(map[string]interface{})
+		data, ok = defaultData["circuit_breaker"].(map[string]interface{})
+	}
+	if !ok {
+		return nil
+	}
+
+	errorRate, _ := data["error_rate"].(float64)
+	minRequests, _ := data["min_requests"].(float64)
+	window := DefaultCircuitBreakerWindow
+	if value, ok := data["window"].(float64); ok {
+		window = value
+	}
+	cooldown := DefaultCircuitBreakerCooldown
+	if value, ok := data["cooldown"].(float64); ok {
+		cooldown = value
+	}
+
+	if errorRate < 0 || errorRate > 1 {
+		fmt.Fprintf(os.Stderr, "Invalid circuit breaker error rate %v for source %s\n", errorRate, sourceName)
+		os.Exit(1)
+	}
+	if window <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid circuit breaker window %v for source %s\n", window, sourceName)
+		os.Exit(1)
+	}
+	if cooldown < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid circuit breaker cooldown %v for source %s\n", cooldown, sourceName)
+		os.Exit(1)
+	}
+
+	return &CircuitBreakerConfig{
+		ErrorRate:     errorRate,
+		MinRequests:   uint64(minRequests),
+		Window:        window,
+		Cooldown:      cooldown,
+		StatterConfig: c.parseStatterConfig(),
+	}
+}
+
+func (c *configParser) parseChainFallthrough(sourceName string) []ImageErrorKind {
+	kindNames := c.stringsForKeypath("sources.%s.fallthrough", sourceName)
+	if len(kindNames) == 0 {
+		return DefaultChainFallthrough
+	}
+
+	kinds := make([]ImageErrorKind, 0, len(kindNames))
+	for _, kindName := range kindNames {
+		kind := ImageErrorKind(kindName)
+		if _, ok := imageErrorKindStatusCodes[kind]; !ok {
+			fmt.Fprintf(os.Stderr, "Invalid fallthrough error %s for source %s\n", kindName, sourceName)
+			os.Exit(1)
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds
+}
+
+// resolveChainSourceConfigs resolves the names of the member sources of chain
+// sources to their configurations, once all sources have been parsed.
+func resolveChainSourceConfigs(sourceConfigsByName map[string]*SourceConfig) {
+	for _, sourceConfig := range sourceConfigsByName {
+		if sourceConfig.Type != ImageSourceTypeChain {
+			continue
+		}
+		if len(sourceConfig.ChainSourceNames) == 0 {
+			fmt.Fprintf(os.Stderr, "No sources specified for chain source %s\n", sourceConfig.Name)
+			os.Exit(1)
+		}
+		for _, memberName := range sourceConfig.ChainSourceNames {
+			memberConfig, ok := sourceConfigsByName[memberName]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Unknown source %s in chain source %s\n", memberName, sourceConfig.Name)
+				os.Exit(1)
+			}
+			sourceConfig.ChainSourceConfigs = append(sourceConfig.ChainSourceConfigs, memberConfig)
+		}
+	}
+
+	for _, sourceConfig := range sourceConfigsByName {
+		checkChainSourceCycle(sourceConfig, nil)
+	}
+}
+
+// checkChainSourceCycle exits if a chain source contains itself, directly or
+// through other chain sources.
+func checkChainSourceCycle(sourceConfig *SourceConfig, path []string) {
+	for _, name := range path {
+		if name == sourceConfig.Name {
+			fmt.Fprintf(os.Stderr, "Chain source %s contains itself\n", sourceConfig.Name)
+			os.Exit(1)
+		}
+	}
+	for _, memberConfig := range sourceConfig.ChainSourceConfigs {
+		checkChainSourceCycle(memberConfig, append(path, sourceConfig.Name))
 	}
 }
 
@@ -229,6 +585,16 @@ func (c *configParser) parseProcessorConfig(processorName string) *ProcessorConf
 		scaleMode = ScaleFill
 	}
 
+	backgroundColor := DefaultBackgroundColor
+	if colorName := c.stringForKeypath("processors.%s.default_background_color", processorName); colorName != "" {
+		var err error
+		backgroundColor, err = ParseColor(colorName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid default background color %s for processor %s\n", colorName, processorName)
+			os.Exit(1)
+		}
+	}
+
 	maxDimensions := ImageDimensions{
 		Width:  uint(c.uintForKeypath("processors.%s.max_image_width", processorName)),
 		Height: uint(c.uintForKeypath("processors.%s.max_image_height", processorName)),
@@ -247,16 +613,34 @@ func (c *configParser) parseProcessorConfig(processorName string) *ProcessorConf
 		}
 	}
 
+	var outputFormats []string
+	for _, formatName := range c.stringsForKeypath("processors.%s.output_formats", processorName) {
+		outputFormat, ok := ImageFormats[strings.ToLower(formatName)]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown output format %s for processor %s\n", formatName, processorName)
+			os.Exit(1)
+		}
+		outputFormats = append(outputFormats, outputFormat)
+	}
+
 	config := &ProcessorConfig{
-		Name: processorName,
+		Name:                    processorName,
 		ImageCompressionQuality: c.uintForKeypath("processors.%s.image_compression_quality", processorName),
+		MinQuality:              c.uintForKeypath("processors.%s.min_quality", processorName),
+		MaxQuality:              c.uintForKeypath("processors.%s.max_quality", processorName),
 		DefaultScaleMode:        scaleMode,
 		DefaultImageHeight:      c.uintForKeypath("processors.%s.default_image_height", processorName),
 		DefaultImageWidth:       c.uintForKeypath("processors.%s.default_image_width", processorName),
+		DefaultBackgroundColor:  backgroundColor,
 		MaxImageDimensions:      maxDimensions,
+		MaxInputPixels:          c.uintForKeypath("processors.%s.max_input_pixels", processorName),
+		MaxInputWidth:           c.uintForKeypath("processors.%s.max_input_width", processorName),
+		MaxInputHeight:          c.uintForKeypath("processors.%s.max_input_height", processorName),
 		MaxBlurRadiusPercentage: c.floatForKeypath("processors.%s.max_blur_radius_percentage", processorName),
 		AutoOrient:              c.boolForKeypath("processors.%s.auto_orient", processorName),
 		Formats:                 formats,
+		OutputFormats:           outputFormats,
+		AutoFormat:              c.boolForKeypath("processors.%s.auto_format", processorName),
 
 		// DEPRECATED
 		MaintainAspectRatio: c.boolForKeypath("processors.%s.maintain_aspect_ratio", processorName),
@@ -282,10 +666,12 @@ func (c *configParser) valueForKeypath(valueType reflect.Kind, keypathFormat str
 	}
 
 	switch value.(type) {
-	case string, bool, float64:
+	case string, bool, float64, []interface{}:
 		return value
 	case nil:
 		switch valueType {
+		case reflect.Slice:
+			return []interface{}{}
 		case reflect.Float64:
 			return float64(0)
 		case reflect.String:
@@ -300,6 +686,21 @@ func (c *configParser) valueForKeypath(valueType reflect.Kind, keypathFormat str
 	}
 }
 
+// hasValueForKeypath returns a bool indicating whether the setting is specified,
+// either directly or, like valueForKeypath, in the default section.
+func (c *configParser) hasValueForKeypath(keypathFormat string, v ...interface{}) bool {
+	keypath := fmt.Sprintf(keypathFormat, v...)
+	components := strings.Split(keypath, ".")
+	var currentData = c.data
+	for _, component := range components[:len(components)-1] {
+		currentData, _ = currentData[component].(map[string]interface{})
+	}
+	if currentData[components[len(components)-1]] != nil {
+		return true
+	}
+	return len(v) > 0 && c.hasValueForKeypath(fmt.Sprintf(keypathFormat, "default"))
+}
+
 func (c *configParser) stringForKeypath(keypathFormat string, v ...interface{}) string {
 	return c.valueForKeypath(reflect.String, keypathFormat, v...).(string)
 }
@@ -308,10 +709,43 @@ func (c *configParser) floatForKeypath(keypathFormat string, v ...interface{}) f
 	return c.valueForKeypath(reflect.Float64, keypathFormat, v...).(float64)
 }
 
+// secondsForKeypath returns a setting in seconds, or defaultSeconds if it's
+// unspecified. A setting of zero is returned as is, e.g. to disable a timeout.
+func (c *configParser) secondsForKeypath(defaultSeconds float64, keypathFormat string, v ...interface{}) float64 {
+	if !c.hasValueForKeypath(keypathFormat, v...) {
+		return defaultSeconds
+	}
+	seconds := c.floatForKeypath(keypathFormat, v...)
+	if seconds < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value %v for %s: expected a non-negative number of seconds\n",
+			seconds, fmt.Sprintf(keypathFormat, v...))
+		os.Exit(1)
+	}
+	return seconds
+}
+
 func (c *configParser) uintForKeypath(keypathFormat string, v ...interface{}) uint64 {
 	return uint64(c.floatForKeypath(keypathFormat, v...))
 }
 
+func (c *configParser) stringsForKeypath(keypathFormat string, v ...interface{}) []string {
+	values, ok := c.valueForKeypath(reflect.Slice, keypathFormat, v...).([]interface{})
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Invalid value for %s: expected a list of strings\n", fmt.Sprintf(keypathFormat, v...))
+		os.Exit(1)
+	}
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Invalid value %v for %s: expected a string\n", value, fmt.Sprintf(keypathFormat, v...))
+			os.Exit(1)
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
 func (c *configParser) boolForKeypath(keypathFormat string, v ...interface{}) bool {
 	return c.valueForKeypath(reflect.Bool, keypathFormat, v...).(bool)
 }
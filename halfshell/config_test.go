@@ -0,0 +1,62 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"testing"
+)
+
+func TestConfigParserSecondsForKeypath(t *testing.T) {
+	parser := &configParser{data: map[string]interface{}{
+		"sources": map[string]interface{}{
+			"default": map[string]interface{}{"response_timeout": float64(10)},
+			"images": map[string]interface{}{
+				"connect_timeout":  float64(0),
+				"response_timeout": float64(2.5),
+			},
+			"thumbnails": map[string]interface{}{},
+		},
+	}}
+
+	tests := []struct {
+		source   string
+		key      string
+		expected float64
+	}{
+		{"images", "connect_timeout", 0},
+		{"images", "response_timeout", 2.5},
+		{"images", "idle_connection_timeout", DefaultIdleConnectionTimeout},
+		{"thumbnails", "connect_timeout", DefaultConnectTimeout},
+		{"thumbnails", "response_timeout", 10},
+	}
+
+	for _, test := range tests {
+		defaultSeconds := map[string]float64{
+			"connect_timeout":         DefaultConnectTimeout,
+			"response_timeout":        DefaultResponseTimeout,
+			"idle_connection_timeout": DefaultIdleConnectionTimeout,
+		}[test.key]
+		seconds := parser.secondsForKeypath(defaultSeconds, "sources.%s."+test.key, test.source)
+		if seconds != test.expected {
+			t.Errorf("%s.%s: got %v, expected %v", test.source, test.key, seconds, test.expected)
+		}
+	}
+}
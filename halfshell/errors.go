@@ -0,0 +1,166 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+// ImageErrorKind classifies the errors that occur while retrieving or
+// processing images. Each kind maps to an HTTP status code and is reported to
+// StatsD as errors.<kind>.
+type ImageErrorKind string
+
+const (
+	// Errors returned by image sources.
+	ErrorKindNotFound             ImageErrorKind = "not_found"
+	ErrorKindForbidden            ImageErrorKind = "forbidden"
+	ErrorKindUpstreamUnavailable  ImageErrorKind = "upstream_unavailable"
+	ErrorKindTimeout              ImageErrorKind = "timeout"
+	ErrorKindInvalidImage         ImageErrorKind = "invalid_image"
+	ErrorKindCircuitOpen          ImageErrorKind = "circuit_open"
+	ErrorKindSourceTooLarge       ImageErrorKind = "source_too_large"
+	ErrorKindUnsupportedMediaType ImageErrorKind = "unsupported_media_type"
+	ErrorKindURLNotAllowed        ImageErrorKind = "url_not_allowed"
+
+	// Errors returned by image processors.
+	ErrorKindBadOptions    ImageErrorKind = "bad_options"
+	ErrorKindDecodeFailure ImageErrorKind = "decode_failure"
+	ErrorKindLimitExceeded ImageErrorKind = "limit_exceeded"
+
+	// ErrorKindInternal is the kind of all other errors.
+	ErrorKindInternal ImageErrorKind = "internal"
+)
+
+// imageErrorKindStatusCodes maps error kinds to HTTP status codes. Sources
+// denying access to an image are reported as not found, since S3 responds with
+// 403 Forbidden for missing objects unless the bucket can be listed.
+var imageErrorKindStatusCodes = map[ImageErrorKind]int{
+	ErrorKindNotFound:             http.StatusNotFound,
+	ErrorKindForbidden:            http.StatusNotFound,
+	ErrorKindUpstreamUnavailable:  http.StatusBadGateway,
+	ErrorKindTimeout:              http.StatusGatewayTimeout,
+	ErrorKindInvalidImage:         http.StatusUnprocessableEntity,
+	ErrorKindCircuitOpen:          http.StatusServiceUnavailable,
+	ErrorKindSourceTooLarge:       http.StatusRequestEntityTooLarge,
+	ErrorKindUnsupportedMediaType: http.StatusUnsupportedMediaType,
+	ErrorKindURLNotAllowed:        http.StatusForbidden,
+	ErrorKindBadOptions:           http.StatusBadRequest,
+	ErrorKindDecodeFailure:        http.StatusUnprocessableEntity,
+	ErrorKindLimitExceeded:        http.StatusRequestEntityTooLarge,
+	ErrorKindInternal:             http.StatusInternalServerError,
+}
+
+// ImageError is an error that occurred while retrieving or processing an
+// image. Its message is safe to return to clients; details are kept in the
+// underlying error.
+type ImageError struct {
+	Kind    ImageErrorKind
+	Message string
+	Err     error
+}
+
+// NewImageError returns a new ImageError of the given kind with a formatted
+// message.
+func NewImageError(kind ImageErrorKind, err error, format string, v ...interface{}) *ImageError {
+	return &ImageError{
+		Kind:    kind,
+		Message: fmt.Sprintf(format, v...),
+		Err:     err,
+	}
+}
+
+func (e *ImageError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %v", e.Message, e.Err)
+}
+
+// StatusCode returns the HTTP status code of the response for the error.
+func (e *ImageError) StatusCode() int {
+	if statusCode, ok := imageErrorKindStatusCodes[e.Kind]; ok {
+		return statusCode
+	}
+	return http.StatusInternalServerError
+}
+
+// ImageErrorFromError returns err if it is an ImageError, or wraps it in an
+// ImageError of kind ErrorKindInternal otherwise.
+func ImageErrorFromError(err error) *ImageError {
+	if imageError, ok := err.(*ImageError); ok {
+		return imageError
+	}
+	return NewImageError(ErrorKindInternal, err, "Internal Server Error")
+}
+
+// IsImageErrorKind returns a bool indicating whether err is an ImageError of
+// the given kind.
+func IsImageErrorKind(err error, kind ImageErrorKind) bool {
+	imageError, ok := err.(*ImageError)
+	return ok && imageError.Kind == kind
+}
+
+// imageErrorForRequestError classifies an error returned by an HTTP client.
+func imageErrorForRequestError(err error) *ImageError {
+	var imageError *ImageError
+	if errors.As(err, &imageError) {
+		return imageError
+	}
+	if errors.Is(err, errURLNotAllowed) {
+		return NewImageError(ErrorKindURLNotAllowed, err, "Image URL not allowed")
+	}
+	if netError, ok := err.(net.Error); ok && netError.Timeout() {
+		return NewImageError(ErrorKindTimeout, err, "Timed out retrieving image")
+	}
+	return NewImageError(ErrorKindUpstreamUnavailable, err, "Unable to retrieve image")
+}
+
+// imageErrorForStatusCode classifies an unsuccessful HTTP response status.
+func imageErrorForStatusCode(statusCode int) *ImageError {
+	err := fmt.Errorf("upstream responded with status %d", statusCode)
+	switch {
+	case statusCode == http.StatusNotFound || statusCode == http.StatusGone:
+		return NewImageError(ErrorKindNotFound, err, "Image not found")
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return NewImageError(ErrorKindForbidden, err, "Access to image denied")
+	case statusCode == http.StatusGatewayTimeout:
+		return NewImageError(ErrorKindTimeout, err, "Timed out retrieving image")
+	default:
+		return NewImageError(ErrorKindUpstreamUnavailable, err, "Unable to retrieve image")
+	}
+}
+
+// imageErrorForFileError classifies an error returned by file operations.
+func imageErrorForFileError(err error) *ImageError {
+	switch {
+	case os.IsNotExist(err):
+		return NewImageError(ErrorKindNotFound, err, "Image not found")
+	case os.IsPermission(err):
+		return NewImageError(ErrorKindForbidden, err, "Access to image denied")
+	default:
+		return NewImageError(ErrorKindUpstreamUnavailable, err, "Unable to retrieve image")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestImageErrorStatusCode(t *testing.T) {
+	tests := []struct {
+		kind       ImageErrorKind
+		statusCode int
+	}{
+		{ErrorKindNotFound, http.StatusNotFound},
+		{ErrorKindForbidden, http.StatusNotFound},
+		{ErrorKindUpstreamUnavailable, http.StatusBadGateway},
+		{ErrorKindTimeout, http.StatusGatewayTimeout},
+		{ErrorKindInvalidImage, http.StatusUnprocessableEntity},
+		{ErrorKindCircuitOpen, http.StatusServiceUnavailable},
+		{ErrorKindSourceTooLarge, http.StatusRequestEntityTooLarge},
+		{ErrorKindUnsupportedMediaType, http.StatusUnsupportedMediaType},
+		{ErrorKindURLNotAllowed, http.StatusForbidden},
+		{ErrorKindBadOptions, http.StatusBadRequest},
+		{ErrorKindDecodeFailure, http.StatusUnprocessableEntity},
+		{ErrorKindLimitExceeded, http.StatusRequestEntityTooLarge},
+		{ErrorKindInternal, http.StatusInternalServerError},
+		{ImageErrorKind("unknown"), http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		err := NewImageError(test.kind, nil, "message")
+		if statusCode := err.StatusCode(); statusCode != test.statusCode {
+			t.Errorf("%s: got status code %d, expected %d", test.kind, statusCode, test.statusCode)
+		}
+	}
+
+	if len(imageErrorKindStatusCodes) != len(tests)-1 {
+		t.Errorf("got %d error kinds with status codes, expected %d", len(imageErrorKindStatusCodes), len(tests)-1)
+	}
+}
+
+func TestImageErrorFromError(t *testing.T) {
+	imageError := NewImageError(ErrorKindNotFound, nil, "Image not found")
+	if err := ImageErrorFromError(imageError); err != imageError {
+		t.Errorf("got %v, expected %v", err, imageError)
+	}
+
+	err := ImageErrorFromError(errors.New("failure"))
+	if err.Kind != ErrorKindInternal || err.StatusCode() != http.StatusInternalServerError {
+		t.Errorf("got %s error with status code %d, expected internal error", err.Kind, err.StatusCode())
+	}
+}
+
+func TestImageErrorForStatusCode(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		kind       ImageErrorKind
+	}{
+		{http.StatusNotFound, ErrorKindNotFound},
+		{http.StatusGone, ErrorKindNotFound},
+		{http.StatusUnauthorized, ErrorKindForbidden},
+		{http.StatusForbidden, ErrorKindForbidden},
+		{http.StatusGatewayTimeout, ErrorKindTimeout},
+		{http.StatusInternalServerError, ErrorKindUpstreamUnavailable},
+	}
+
+	for _, test := range tests {
+		if err := imageErrorForStatusCode(test.statusCode); err.Kind != test.kind {
+			t.Errorf("%d: got %s, expected %s", test.statusCode, err.Kind, test.kind)
+		}
+	}
+}
@@ -22,6 +22,7 @@ package halfshell
 
 import (
 	"os"
+	"strconv"
 	"text/template"
 
 	"github.com/rafikk/imagick/imagick"
@@ -59,8 +60,41 @@ func (h *Halfshell) Run() {
 	var tmpl, _ = template.New("start").Parse(StartupTemplateString)
 	_ = tmpl.Execute(os.Stdout, h)
 
+	// ImageMagick reads its resource limits from the environment when it's
+	// initialized.
+	h.setResourceLimits()
+
 	imagick.Initialize()
 	defer imagick.Terminate()
 
 	h.Server.ListenAndServe()
 }
+
+// setResourceLimits sets the environment variables holding the configured
+// ImageMagick resource limits.
+func (h *Halfshell) setResourceLimits() {
+	config := h.Config.ResourceLimitsConfig
+	limits := []struct {
+		name        string
+		environment string
+		limit       uint64
+	}{
+		{"memory", "MAGICK_MEMORY_LIMIT", config.Memory},
+		{"map", "MAGICK_MAP_LIMIT", config.Map},
+		{"disk", "MAGICK_DISK_LIMIT", config.Disk},
+		{"area", "MAGICK_AREA_LIMIT", config.Area},
+		{"threads", "MAGICK_THREAD_LIMIT", config.Threads},
+		{"time", "MAGICK_TIME_LIMIT", config.Time},
+	}
+
+	for _, limit := range limits {
+		if limit.limit == 0 {
+			continue
+		}
+		if err := os.Setenv(limit.environment, strconv.FormatUint(limit.limit, 10)); err != nil {
+			h.Logger.Errorf("Unable to set %s resource limit: %v", limit.name, err)
+			continue
+		}
+		h.Logger.Infof("Set %s resource limit to %d", limit.name, limit.limit)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultConnectTimeout            = 5.0
+	DefaultResponseTimeout           = 30.0
+	DefaultIdleConnectionTimeout     = 90.0
+	DefaultMaxIdleConnectionsPerHost = 16
+	DefaultRetryBackoff              = 0.1
+	DefaultRetryMaxBackoff           = 2.0
+)
+
+var (
+	httpClientsBySource      = make(map[*SourceConfig]*HTTPClient)
+	httpClientsBySourceMutex sync.Mutex
+)
+
+// HTTPClient performs the requests of network sources. Requests that fail to
+// connect or receive a 5xx response are retried with exponential backoff and
+// jitter. Only requests without a body should be made with it, since they are
+// sent again as is when retried.
+type HTTPClient struct {
+	Client          *http.Client
+	MaxRetries      uint64
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
+	Logger          *Logger
+}
+
+// HTTPClientForConfig returns the HTTP client for the source, creating it if
+// needed. Routes using the same source share its client and connection pool.
+func HTTPClientForConfig(config *SourceConfig) *HTTPClient {
+	httpClientsBySourceMutex.Lock()
+	defer httpClientsBySourceMutex.Unlock()
+
+	client, ok := httpClientsBySource[config]
+	if !ok {
+		client = NewHTTPClientWithConfig(config)
+		httpClientsBySource[config] = client
+	}
+	return client
+}
+
+// NewHTTPClientWithConfig returns a new HTTP client configured with the
+// source's timeout, connection pool and retry settings.
+func NewHTTPClientWithConfig(config *SourceConfig) *HTTPClient {
+	dialer := &net.Dialer{
+		Timeout:   secondsDuration(config.ConnectTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   secondsDuration(config.ConnectTimeout),
+		MaxIdleConnsPerHost:   int(config.MaxIdleConnectionsPerHost),
+		MaxConnsPerHost:       int(config.MaxConnectionsPerHost),
+		IdleConnTimeout:       secondsDuration(config.IdleConnectionTimeout),
+		DisableKeepAlives:     config.DisableKeepAlives,
+		ExpectContinueTimeout: time.Second,
+	}
+	if transport.MaxIdleConnsPerHost == 0 {
+		transport.MaxIdleConnsPerHost = DefaultMaxIdleConnectionsPerHost
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   secondsDuration(config.ResponseTimeout),
+	}
+
+	// Connections for remote URLs are made directly, so that the addresses
+	// they resolve to can be checked.
+	if config.RemoteURLs {
+		policy := NewRemoteURLPolicyWithConfig(config)
+		dialer.Control = policy.Control
+		transport.Proxy = nil
+		client.CheckRedirect = policy.CheckRedirect
+	}
+
+	return &HTTPClient{
+		Client:          client,
+		MaxRetries:      config.MaxRetries,
+		RetryBackoff:    secondsDuration(config.RetryBackoff),
+		RetryMaxBackoff: secondsDuration(config.RetryMaxBackoff),
+		Logger:          NewLogger("http.%s", config.Name),
+	}
+}
+
+// Do sends the request, retrying it on connection errors and 5xx responses.
+// The response of the last attempt is returned.
+func (c *HTTPClient) Do(request *http.Request) (*http.Response, error) {
+	for attempt := uint64(0); ; attempt++ {
+		response, err := c.Client.Do(request)
+		if attempt >= c.MaxRetries || !shouldRetryHTTPResponse(response, err) {
+			return response, err
+		}
+
+		if err != nil {
+			c.Logger.Warnf("Retrying %s %v after error: %v", request.Method, request.URL, err)
+		} else {
+			c.Logger.Warnf("Retrying %s %v after status %d", request.Method, request.URL, response.StatusCode)
+			response.Body.Close()
+		}
+		time.Sleep(c.retryDelay(attempt))
+	}
+}
+
+// retryDelay returns a random delay of up to RetryBackoff * 2^attempt, capped
+// at RetryMaxBackoff.
+func (c *HTTPClient) retryDelay(attempt uint64) time.Duration {
+	// The backoff is only doubled while it stays below the maximum, so that
+	// the shift can't overflow.
+	backoff := c.RetryMaxBackoff
+	if attempt < 63 && c.RetryBackoff <= c.RetryMaxBackoff>>attempt {
+		backoff = c.RetryBackoff << attempt
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
+
+func shouldRetryHTTPResponse(response *http.Response, err error) bool {
+	var imageError *ImageError
+	if errors.As(err, &imageError) || errors.Is(err, errURLNotAllowed) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	return response.StatusCode >= 500 && response.StatusCode != http.StatusNotImplemented
+}
+
+// secondsDuration converts a setting in seconds to a duration.
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
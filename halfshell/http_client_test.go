@@ -0,0 +1,59 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHTTPClientRetryDelay(t *testing.T) {
+	client := &HTTPClient{RetryBackoff: 100 * time.Millisecond, RetryMaxBackoff: 2 * time.Second}
+	tests := []struct {
+		attempt  uint64
+		maxDelay time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{4, 1600 * time.Millisecond},
+		{5, 2 * time.Second},
+		{40, 2 * time.Second},
+		{64, 2 * time.Second},
+		{1 << 40, 2 * time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			if delay := client.retryDelay(test.attempt); delay < 0 || delay >= test.maxDelay {
+				t.Fatalf("attempt %d: got delay %v, expected less than %v", test.attempt, delay, test.maxDelay)
+			}
+		}
+	}
+
+	client = &HTTPClient{RetryBackoff: 0, RetryMaxBackoff: 2 * time.Second}
+	if delay := client.retryDelay(3); delay != 0 {
+		t.Errorf("got delay %v without backoff, expected 0", delay)
+	}
+	client = &HTTPClient{RetryBackoff: 100 * time.Millisecond, RetryMaxBackoff: 0}
+	if delay := client.retryDelay(3); delay != 0 {
+		t.Errorf("got delay %v without maximum backoff, expected 0", delay)
+	}
+}
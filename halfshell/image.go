@@ -21,12 +21,19 @@
 package halfshell
 
 import (
+	"bytes"
 	"fmt"
+	goimage "image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rafikk/imagick/imagick"
 )
@@ -35,34 +42,133 @@ var EmptyImageDimensions = ImageDimensions{}
 var EmptyResizeDimensions = ResizeDimensions{}
 var DefaultFocalPoint = Focalpoint{0.5, 0.5}
 
+// ImageFormats maps the output format names accepted in requests to the
+// corresponding ImageMagick format names.
+var ImageFormats = map[string]string{
+	"jpeg": "JPEG",
+	"jpg":  "JPEG",
+	"png":  "PNG",
+	"webp": "WEBP",
+	"gif":  "GIF",
+	"avif": "AVIF",
+}
+
+var imageFormatMIMETypes = map[string]string{
+	"JPEG": "image/jpeg",
+	"PNG":  "image/png",
+	"WEBP": "image/webp",
+	"GIF":  "image/gif",
+	"AVIF": "image/avif",
+}
+
+// ImageLimits bounds the dimensions of images that sources decode, to protect
+// against images that decode to very large numbers of pixels. A limit of 0 is
+// unlimited.
+type ImageLimits struct {
+	MaxPixels uint64
+	MaxWidth  uint64
+	MaxHeight uint64
+}
+
 type Image struct {
 	Wand      *imagick.MagickWand
 	Signature string
+	Metadata  ImageMetadata
 	destroyed bool
 }
 
 func NewImageFromBuffer(buffer io.Reader) (image *Image, err error) {
 	bytes, err := ioutil.ReadAll(buffer)
 	if err != nil {
-		return nil, err
+		return nil, imageErrorForRequestError(err)
+	}
+	return NewImageFromBytes(bytes, nil)
+}
+
+// NewImageFromBytes decodes an image from its encoded data. If limits are
+// given, the dimensions of the image are checked against them. The dimensions
+// of GIF, JPEG and PNG images are read from their headers before the images
+// are decoded, and those of other images once they're decoded.
+func NewImageFromBytes(bytes []byte, limits *ImageLimits) (image *Image, err error) {
+	if len(bytes) == 0 {
+		return nil, NewImageError(ErrorKindInvalidImage, nil, "Image is empty")
+	}
+
+	if limits != nil {
+		if err := limits.check(bytes); err != nil {
+			return nil, err
+		}
 	}
 
 	image = &Image{Wand: imagick.NewMagickWand()}
 	err = image.Wand.ReadImageBlob(bytes)
 	if err != nil {
-		return nil, err
+		image.Destroy()
+		return nil, NewImageError(ErrorKindDecodeFailure, err, "Unable to decode image")
+	}
+
+	if limits != nil {
+		err = limits.checkDimensions(uint64(image.Wand.GetImageWidth()), uint64(image.Wand.GetImageHeight()))
+		if err != nil {
+			image.Destroy()
+			return nil, err
+		}
 	}
 
 	return image, nil
 }
 
+// check reads the dimensions of the image from its header, without decoding
+// it, and returns an error if they exceed the limits. Images whose headers
+// can't be read by the standard library are left to be checked once decoded.
+func (l *ImageLimits) check(data []byte) error {
+	if l.MaxPixels == 0 && l.MaxWidth == 0 && l.MaxHeight == 0 {
+		return nil
+	}
+
+	config, _, err := goimage.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	return l.checkDimensions(uint64(config.Width), uint64(config.Height))
+}
+
+// checkDimensions returns an error if the dimensions exceed the limits.
+func (l *ImageLimits) checkDimensions(width, height uint64) error {
+	switch {
+	case l.MaxWidth > 0 && width > l.MaxWidth,
+		l.MaxHeight > 0 && height > l.MaxHeight:
+		return NewImageError(ErrorKindLimitExceeded,
+			fmt.Errorf("image dimensions %dx%d exceed %dx%d", width, height, l.MaxWidth, l.MaxHeight),
+			"Image dimensions exceed limits")
+	case l.MaxPixels > 0 && width*height > l.MaxPixels:
+		return NewImageError(ErrorKindLimitExceeded,
+			fmt.Errorf("image has %d pixels, more than %d", width*height, l.MaxPixels),
+			"Image dimensions exceed limits")
+	}
+	return nil
+}
+
 func NewImageFromFile(file *os.File) (image *Image, err error) {
 	image, err = NewImageFromBuffer(file)
 	return image, err
 }
 
+// Clone returns a copy of the image that can be processed independently.
+func (i *Image) Clone() *Image {
+	return &Image{
+		Wand:      i.Wand.Clone(),
+		Signature: i.Signature,
+		Metadata:  i.Metadata,
+	}
+}
+
 func (i *Image) GetMIMEType() string {
-	return fmt.Sprintf("image/%s", strings.ToLower(i.Wand.GetImageFormat()))
+	format := i.Wand.GetImageFormat()
+	if mimeType, ok := imageFormatMIMETypes[format]; ok {
+		return mimeType
+	}
+	return fmt.Sprintf("image/%s", strings.ToLower(format))
 }
 
 func (i *Image) GetBytes() (bytes []byte, size int) {
@@ -71,6 +177,18 @@ func (i *Image) GetBytes() (bytes []byte, size int) {
 	return bytes, size
 }
 
+// Encode returns the image encoded in its current format along with the
+// headers needed to serve it.
+func (i *Image) Encode(etag string) *EncodedImage {
+	bytes, _ := i.GetBytes()
+	return &EncodedImage{
+		Bytes:        bytes,
+		ContentType:  i.GetMIMEType(),
+		ETag:         etag,
+		LastModified: i.Metadata.LastModified,
+	}
+}
+
 func (i *Image) GetWidth() uint {
 	return i.Wand.GetImageWidth()
 }
@@ -94,6 +212,14 @@ func (i *Image) Destroy() {
 	}
 }
 
+// EncodedImage is a processed image encoded in its output format.
+type EncodedImage struct {
+	Bytes        []byte
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+}
+
 type ImageDimensions struct {
 	Width  uint
 	Height uint
@@ -110,6 +236,8 @@ func (d ImageDimensions) String() string {
 type ResizeDimensions struct {
 	Scale ImageDimensions
 	Crop  ImageDimensions
+	// Pad is the size of the canvas that the image is extended to.
+	Pad ImageDimensions
 }
 
 // Focalpoint is a float pair representing the location of the image subject.
@@ -122,20 +250,143 @@ type Focalpoint struct {
 // NewFocalpointFromString splits the given string into a Focalpoint struct. The
 // string format should be: "X,Y". For example: "0.1,0.1".
 func NewFocalpointFromString(s string) (fp Focalpoint) {
+	fp, err := ParseFocalpoint(s)
+	if err != nil {
+		return DefaultFocalPoint
+	}
+	return fp
+}
+
+// ParseFocalpoint parses a focal point in the format "X,Y". An error is
+// returned if the string is not in that format.
+func ParseFocalpoint(s string) (Focalpoint, error) {
 	pair := strings.Split(s, ",")
 	if len(pair) != 2 {
-		return DefaultFocalPoint
+		return Focalpoint{}, fmt.Errorf("invalid focal point %q", s)
 	}
 
-	x, err := strconv.ParseFloat(pair[0], 64)
+	x, err := strconv.ParseFloat(strings.TrimSpace(pair[0]), 64)
 	if err != nil {
-		return DefaultFocalPoint
+		return Focalpoint{}, fmt.Errorf("invalid focal point %q", s)
 	}
 
-	y, err := strconv.ParseFloat(pair[1], 64)
+	y, err := strconv.ParseFloat(strings.TrimSpace(pair[1]), 64)
 	if err != nil {
-		return DefaultFocalPoint
+		return Focalpoint{}, fmt.Errorf("invalid focal point %q", s)
+	}
+
+	return Focalpoint{x, y}, nil
+}
+
+// Valid returns whether the focal point lies within the image.
+func (fp Focalpoint) Valid() bool {
+	return fp.X >= 0 && fp.X <= 1 && fp.Y >= 0 && fp.Y <= 1
+}
+
+// String returns the focal point in the format accepted by ParseFocalpoint.
+func (fp Focalpoint) String() string {
+	return fmt.Sprintf("%g,%g", fp.X, fp.Y)
+}
+
+// ParseColor parses a color given as "transparent" or as hexadecimal RGB or
+// RGBA values, with or without a leading "#", e.g. "fff", "#ff8800" or
+// "ff880080". It returns the color in the format understood by ImageMagick.
+func ParseColor(s string) (string, error) {
+	if strings.ToLower(s) == "transparent" {
+		return "none", nil
+	}
+
+	hex := strings.TrimPrefix(s, "#")
+	switch len(hex) {
+	case 3, 4, 6, 8:
+	default:
+		return "", fmt.Errorf("invalid color %q", s)
+	}
+	if _, err := strconv.ParseUint(hex, 16, 32); err != nil {
+		return "", fmt.Errorf("invalid color %q", s)
+	}
+
+	return "#" + strings.ToLower(hex), nil
+}
+
+// CropRegion is a rectangle of the original image that's extracted before the
+// image is resized. If Relative is true, the values are fractions of the image
+// dimensions, otherwise they are pixels.
+type CropRegion struct {
+	X        float64
+	Y        float64
+	Width    float64
+	Height   float64
+	Relative bool
+}
+
+// ParseCropRegion parses a crop region in the format "X,Y,W,H". For example:
+// "10,20,300,200". If the values contain a decimal point, they are fractions
+// of the image dimensions. For example: "0.1,0.2,0.5,0.5". Mixing pixels and
+// fractions is an error.
+func ParseCropRegion(s string) (CropRegion, error) {
+	values := strings.Split(s, ",")
+	if len(values) != 4 {
+		return CropRegion{}, fmt.Errorf("invalid crop region %q", s)
+	}
+
+	var region CropRegion
+	fields := []*float64{&region.X, &region.Y, &region.Width, &region.Height}
+	for i, value := range values {
+		value = strings.TrimSpace(value)
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return CropRegion{}, fmt.Errorf("invalid crop region %q", s)
+		}
+		*fields[i] = f
+		relative := strings.Contains(value, ".")
+		if i > 0 && relative != region.Relative {
+			return CropRegion{}, fmt.Errorf("invalid crop region %q: mixes pixels and fractions", s)
+		}
+		region.Relative = relative
+	}
+
+	return region, nil
+}
+
+// String returns the crop region in the format accepted by ParseCropRegion.
+func (r CropRegion) String() string {
+	values := []float64{r.X, r.Y, r.Width, r.Height}
+	formatted := make([]string, len(values))
+	for i, value := range values {
+		formatted[i] = strconv.FormatFloat(value, 'f', -1, 64)
+		if r.Relative && !strings.Contains(formatted[i], ".") {
+			formatted[i] += ".0"
+		}
+	}
+	return strings.Join(formatted, ",")
+}
+
+// Rect returns the origin and dimensions in pixels of the crop region of an
+// image with the given dimensions. An error is returned if the region is empty
+// or doesn't lie within the image.
+func (r CropRegion) Rect(dimensions ImageDimensions) (x, y int, size ImageDimensions, err error) {
+	width, height := float64(dimensions.Width), float64(dimensions.Height)
+	if r.Relative {
+		width, height = 1, 1
+	}
+	if r.X < 0 || r.Y < 0 || r.Width <= 0 || r.Height <= 0 ||
+		r.X+r.Width > width || r.Y+r.Height > height {
+		return 0, 0, size, fmt.Errorf("crop region %s is outside of the %dx%d image",
+			r, dimensions.Width, dimensions.Height)
+	}
+
+	x0, y0, x1, y1 := r.X, r.Y, r.X+r.Width, r.Y+r.Height
+	if r.Relative {
+		x0, x1 = x0*float64(dimensions.Width), x1*float64(dimensions.Width)
+		y0, y1 = y0*float64(dimensions.Height), y1*float64(dimensions.Height)
+	}
+	x, y = int(math.Floor(x0+0.5)), int(math.Floor(y0+0.5))
+	size.Width = uint(math.Floor(x1+0.5)) - uint(x)
+	size.Height = uint(math.Floor(y1+0.5)) - uint(y)
+	if size.Width == 0 || size.Height == 0 {
+		return 0, 0, size, fmt.Errorf("crop region %s is empty", r)
 	}
 
-	return Focalpoint{x, y}
+	return x, y, size, nil
 }
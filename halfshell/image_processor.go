@@ -21,6 +21,7 @@
 package halfshell
 
 import (
+	"fmt"
 	"math"
 
 	"github.com/rafikk/imagick/imagick"
@@ -31,24 +32,81 @@ const (
 	ScaleAspectFit  = 21
 	ScaleAspectFill = 22
 	ScaleAspectCrop = 23
+	ScaleAspectPad  = 24
 )
 
+// DefaultBackgroundColor is the color of the padding added by ScaleAspectPad
+// when neither the request nor the processor specifies one.
+const DefaultBackgroundColor = "#ffffff"
+
 var ScaleModes = map[string]uint{
 	"fill":        ScaleFill,
 	"aspect_fit":  ScaleAspectFit,
 	"aspect_fill": ScaleAspectFill,
 	"aspect_crop": ScaleAspectCrop,
+	"aspect_pad":  ScaleAspectPad,
+}
+
+var lossyImageFormats = map[string]bool{
+	"JPEG": true,
+	"WEBP": true,
+	"AVIF": true,
+}
+
+// opaqueImageFormats are the output formats that can't hold transparency.
+var opaqueImageFormats = map[string]bool{
+	"JPEG": true,
 }
 
 type ImageProcessor interface {
 	ProcessImage(*Image, *ImageProcessorOptions) error
+	// ValidateOptions returns an error of kind ErrorKindBadOptions if the
+	// options are invalid, so that requests can be rejected before the image
+	// is retrieved.
+	ValidateOptions(*ImageProcessorOptions) error
 }
 
 type ImageProcessorOptions struct {
 	Dimensions ImageDimensions
 	BlurRadius float64
 	ScaleMode  uint
-	Focalpoint Focalpoint
+	// Focalpoint is the focal point of crops. If it is nil, the focal point
+	// stored with the original image is used, if any.
+	Focalpoint *Focalpoint
+	// SmartCrop computes the focal point of crops from the image contents
+	// instead of using Focalpoint.
+	SmartCrop bool
+	// CropRegion is the region of the original image that's extracted before
+	// the image is resized.
+	CropRegion *CropRegion
+	// Background is the color of the padding added by ScaleAspectPad, as
+	// returned by ParseColor. If it is empty, the processor's default
+	// background color is used.
+	Background   string
+	OutputFormat string
+	Quality      uint
+}
+
+// String returns a normalized representation of the options. Options that
+// result in the same processed image have the same representation.
+func (o *ImageProcessorOptions) String() string {
+	focalpoint := ""
+	if o.Focalpoint != nil {
+		focalpoint = o.Focalpoint.String()
+	}
+	s := fmt.Sprintf("w=%d&h=%d&blur=%g&scale_mode=%d&focalpoint=%s&fmt=%s&q=%d",
+		o.Dimensions.Width, o.Dimensions.Height, o.BlurRadius, o.ScaleMode,
+		focalpoint, o.OutputFormat, o.Quality)
+	if o.SmartCrop {
+		s += "&crop=smart"
+	}
+	if o.CropRegion != nil {
+		s += "&crop=" + o.CropRegion.String()
+	}
+	if o.Background != "" {
+		s += "&bg=" + o.Background
+	}
+	return s
 }
 
 type imageProcessor struct {
@@ -71,12 +129,30 @@ func (ip *imageProcessor) ProcessImage(img *Image, req *ImageProcessorOptions) e
 
 	var err error
 
+	err = ip.ValidateOptions(req)
+	if err != nil {
+		ip.Logger.Warnf("Invalid processing options: %s", err)
+		return err
+	}
+
 	err = ip.orient(img, req)
 	if err != nil {
 		ip.Logger.Errorf("Error orienting image: %s", err)
 		return err
 	}
 
+	err = ip.cropRegion(img, req)
+	if err != nil {
+		ip.Logger.Warnf("Error cropping image region: %s", err)
+		return err
+	}
+
+	err = ip.convert(img, req)
+	if err != nil {
+		ip.Logger.Errorf("Error converting image: %s", err)
+		return err
+	}
+
 	err = ip.resize(img, req)
 	if err != nil {
 		ip.Logger.Errorf("Error resizing image: %s", err)
@@ -89,6 +165,39 @@ func (ip *imageProcessor) ProcessImage(img *Image, req *ImageProcessorOptions) e
 		return err
 	}
 
+	err = ip.compress(img, req)
+	if err != nil {
+		ip.Logger.Errorf("Error compressing image: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+func (ip *imageProcessor) ValidateOptions(req *ImageProcessorOptions) error {
+	if req.BlurRadius < 0 || req.BlurRadius > 1 {
+		return NewImageError(ErrorKindBadOptions, nil, "Blur radius must be between 0 and 1")
+	}
+
+	if req.Focalpoint != nil && !req.Focalpoint.Valid() {
+		return NewImageError(ErrorKindBadOptions, nil, "Focal point must be between 0,0 and 1,1")
+	}
+
+	if req.Background != "" {
+		return validateBackground(req.Background, req.OutputFormat)
+	}
+
+	return nil
+}
+
+// validateBackground returns an error of kind ErrorKindBadOptions if the
+// background color is transparent and the format can't hold transparency, as
+// the padding would otherwise be black.
+func validateBackground(background, format string) error {
+	if opaqueImageFormats[format] && colorHasAlpha(background) {
+		return NewImageError(ErrorKindBadOptions, nil,
+			"Background color %s must be opaque for %s images", background, format)
+	}
 	return nil
 }
 
@@ -135,13 +244,68 @@ func (ip *imageProcessor) orient(img *Image, req *ImageProcessorOptions) error {
 	return img.Wand.SetImageOrientation(imagick.ORIENTATION_TOP_LEFT)
 }
 
+// cropRegion extracts the requested region of the image. It runs after the
+// image is oriented, so regions are relative to the image as displayed.
+func (ip *imageProcessor) cropRegion(img *Image, req *ImageProcessorOptions) error {
+	if req.CropRegion == nil {
+		return nil
+	}
+
+	oldDimensions := img.GetDimensions()
+	x, y, dimensions, err := req.CropRegion.Rect(oldDimensions)
+	if err != nil {
+		return NewImageError(ErrorKindBadOptions, err, "Crop region must be within the image")
+	}
+
+	err = img.Wand.CropImage(dimensions.Width, dimensions.Height, x, y)
+	if err != nil {
+		return err
+	}
+	err = img.Wand.SetImagePage(dimensions.Width, dimensions.Height, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	// The focal point stored with the original image is relative to the
+	// original, so it's moved into the region, clamped to its edges.
+	if fp := img.Metadata.Focalpoint; fp != nil {
+		img.Metadata.Focalpoint = &Focalpoint{
+			X: clampUnit((fp.X*float64(oldDimensions.Width) - float64(x)) / float64(dimensions.Width)),
+			Y: clampUnit((fp.Y*float64(oldDimensions.Height) - float64(y)) / float64(dimensions.Height)),
+		}
+	}
+
+	return nil
+}
+
+// clampUnit clamps f to the range 0 to 1.
+func clampUnit(f float64) float64 {
+	return math.Max(0, math.Min(1, f))
+}
+
+func (ip *imageProcessor) convert(img *Image, req *ImageProcessorOptions) error {
+	if req.OutputFormat == "" || req.OutputFormat == img.Wand.GetImageFormat() {
+		return nil
+	}
+	return img.Wand.SetImageFormat(req.OutputFormat)
+}
+
 func (ip *imageProcessor) resize(img *Image, req *ImageProcessorOptions) error {
 	scaleMode := req.ScaleMode
 	if scaleMode == 0 {
 		scaleMode = ip.Config.DefaultScaleMode
 	}
 
-	resize, err := ip.resizePrepare(img.GetDimensions(), req.Dimensions, scaleMode)
+	oldDimensions := img.GetDimensions()
+	reqDimensions := req.Dimensions
+
+	// Cropped regions without requested dimensions are only scaled down to the
+	// maximum dimensions.
+	if req.CropRegion != nil && reqDimensions == EmptyImageDimensions {
+		reqDimensions = clampDimensionsToMaxima(oldDimensions, oldDimensions, ip.Config.MaxImageDimensions)
+	}
+
+	resize, err := ip.resizePrepare(oldDimensions, reqDimensions, scaleMode)
 	if err != nil {
 		return err
 	}
@@ -154,7 +318,22 @@ func (ip *imageProcessor) resize(img *Image, req *ImageProcessorOptions) error {
 	}
 
 	if resize.Crop != EmptyImageDimensions {
-		err = ip.cropApply(img, resize.Crop, req.Focalpoint)
+		err = ip.cropApply(img, resize.Crop, ip.focalpoint(img, req, resize.Crop))
+		if err != nil {
+			return err
+		}
+	}
+
+	if resize.Pad != EmptyImageDimensions {
+		background := req.Background
+		if background == "" {
+			background = ip.Config.DefaultBackgroundColor
+		}
+		err = validateBackground(background, img.Wand.GetImageFormat())
+		if err != nil {
+			return err
+		}
+		err = ip.padApply(img, resize.Pad, ip.requestedFocalpoint(img, req), background)
 		if err != nil {
 			return err
 		}
@@ -222,6 +401,24 @@ func (ip *imageProcessor) resizePrepare(oldDimensions, reqDimensions ImageDimens
 		return resize, nil
 	}
 
+	// Retain the aspect ratio while fitting in the bounds requested, like
+	// ScaleAspectFit, then pad the image to the exact dimensions requested.
+	if scaleMode == ScaleAspectPad {
+		newAspectRatio := reqDimensions.AspectRatio()
+		if newAspectRatio > oldAspectRatio {
+			resize.Scale.Width = aspectWidth(oldAspectRatio, reqDimensions.Height)
+			resize.Scale.Height = reqDimensions.Height
+		} else if newAspectRatio < oldAspectRatio {
+			resize.Scale.Width = reqDimensions.Width
+			resize.Scale.Height = aspectHeight(oldAspectRatio, reqDimensions.Width)
+		} else {
+			resize.Scale.Width = reqDimensions.Width
+			resize.Scale.Height = reqDimensions.Height
+		}
+		resize.Pad = reqDimensions
+		return resize, nil
+	}
+
 	// Use exact width/height and clip off the parts that bleed. The image is
 	// first resized to ensure clipping occurs on the smallest edges possible.
 	if scaleMode == ScaleAspectCrop {
@@ -270,7 +467,87 @@ func (ip *imageProcessor) resizeApply(img *Image, dimensions ImageDimensions) er
 		return err
 	}
 
-	if img.Wand.GetImageFormat() == "JPEG" {
+	return nil
+}
+
+// focalpoint returns the focal point of the crop of the image. Smart cropping
+// takes precedence over the requested focal point.
+func (ip *imageProcessor) focalpoint(img *Image, req *ImageProcessorOptions, crop ImageDimensions) Focalpoint {
+	if req.SmartCrop {
+		focalpoint, err := SmartFocalpoint(img.Wand, crop)
+		if err == nil {
+			return focalpoint
+		}
+		ip.Logger.Warnf("Failed computing smart crop: %s", err)
+	}
+	return ip.requestedFocalpoint(img, req)
+}
+
+// requestedFocalpoint returns the focal point of the request, falling back to
+// the focal point stored with the original image and then to the center.
+func (ip *imageProcessor) requestedFocalpoint(img *Image, req *ImageProcessorOptions) Focalpoint {
+	if req.Focalpoint != nil {
+		return *req.Focalpoint
+	}
+	if img.Metadata.Focalpoint != nil {
+		return *img.Metadata.Focalpoint
+	}
+	return DefaultFocalPoint
+}
+
+func (ip *imageProcessor) cropApply(img *Image, reqDimensions ImageDimensions, focalpoint Focalpoint) error {
+	oldDimensions := img.GetDimensions()
+	x := int(focalpoint.X * (float64(oldDimensions.Width) - float64(reqDimensions.Width)))
+	y := int(focalpoint.Y * (float64(oldDimensions.Height) - float64(reqDimensions.Height)))
+	w := reqDimensions.Width
+	h := reqDimensions.Height
+	return img.Wand.CropImage(w, h, x, y)
+}
+
+// padApply extends the canvas of the image to the given dimensions with the
+// background color. The image is positioned on the canvas by the focal point
+// of its subject, e.g. (0, 0) places it in the top left corner.
+func (ip *imageProcessor) padApply(img *Image, padDimensions ImageDimensions, focalpoint Focalpoint, color string) error {
+	oldDimensions := img.GetDimensions()
+	if oldDimensions == padDimensions {
+		return nil
+	}
+
+	background := imagick.NewPixelWand()
+	defer background.Destroy()
+	background.SetColor(color)
+
+	err := img.Wand.SetImageBackgroundColor(background)
+	if err != nil {
+		ip.Logger.Errorf("Failed setting image background color: %s", err)
+		return err
+	}
+
+	if colorHasAlpha(color) {
+		err = img.Wand.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_ACTIVATE)
+		if err != nil {
+			ip.Logger.Errorf("Failed activating image alpha channel: %s", err)
+			return err
+		}
+	}
+
+	x := int(focalpoint.X * (float64(padDimensions.Width) - float64(oldDimensions.Width)))
+	y := int(focalpoint.Y * (float64(padDimensions.Height) - float64(oldDimensions.Height)))
+	return img.Wand.ExtentImage(padDimensions.Width, padDimensions.Height, -x, -y)
+}
+
+// colorHasAlpha returns whether a color returned by ParseColor may be
+// transparent.
+func colorHasAlpha(color string) bool {
+	return color == "none" || len(color) == len("#rgba") || len(color) == len("#rrggbbaa")
+}
+
+func (ip *imageProcessor) compress(img *Image, req *ImageProcessorOptions) error {
+	format := img.Wand.GetImageFormat()
+
+	var err error
+
+	if format == "JPEG" {
 		err = img.Wand.SetInterlaceScheme(imagick.INTERLACE_PLANE)
 		if err != nil {
 			ip.Logger.Errorf("Failed setting image interlace scheme: %s", err)
@@ -282,24 +559,45 @@ func (ip *imageProcessor) resizeApply(img *Image, dimensions ImageDimensions) er
 			ip.Logger.Errorf("Failed setting image compression type: %s", err)
 			return err
 		}
+	}
 
-		err = img.Wand.SetImageCompressionQuality(uint(ip.Config.ImageCompressionQuality))
-		if err != nil {
-			ip.Logger.Errorf("Failed setting compression quality: %s", err)
-			return err
-		}
+	quality := ip.compressionQuality(req)
+	if !lossyImageFormats[format] || quality == 0 {
+		return nil
+	}
+
+	err = img.Wand.SetImageCompressionQuality(quality)
+	if err != nil {
+		ip.Logger.Errorf("Failed setting compression quality: %s", err)
+		return err
 	}
 
 	return nil
 }
 
-func (ip *imageProcessor) cropApply(img *Image, reqDimensions ImageDimensions, focalpoint Focalpoint) error {
-	oldDimensions := img.GetDimensions()
-	x := int(focalpoint.X * (float64(oldDimensions.Width) - float64(reqDimensions.Width)))
-	y := int(focalpoint.Y * (float64(oldDimensions.Height) - float64(reqDimensions.Height)))
-	w := reqDimensions.Width
-	h := reqDimensions.Height
-	return img.Wand.CropImage(w, h, x, y)
+// compressionQuality returns the requested compression quality, or the
+// processor's default if none was requested, clamped to the processor's
+// quality bounds. A return value of 0 leaves the quality of the image as is.
+func (ip *imageProcessor) compressionQuality(req *ImageProcessorOptions) uint {
+	quality := req.Quality
+	if quality == 0 {
+		quality = uint(ip.Config.ImageCompressionQuality)
+	}
+	if quality == 0 {
+		return 0
+	}
+
+	if minQuality := uint(ip.Config.MinQuality); minQuality > 0 && quality < minQuality {
+		quality = minQuality
+	}
+	if maxQuality := uint(ip.Config.MaxQuality); maxQuality > 0 && quality > maxQuality {
+		quality = maxQuality
+	}
+	if quality > 100 {
+		quality = 100
+	}
+
+	return quality
 }
 
 func (ip *imageProcessor) blur(image *Image, request *ImageProcessorOptions) error {
@@ -0,0 +1,52 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"testing"
+)
+
+func TestImageProcessorValidateOptionsBackground(t *testing.T) {
+	ip := NewImageProcessorWithConfig(&ProcessorConfig{Name: "test"})
+
+	tests := []struct {
+		background string
+		format     string
+		valid      bool
+	}{
+		{"#ff8800", "JPEG", true},
+		{"#ff880080", "PNG", true},
+		{"none", "", true},
+		{"#ff880080", "JPEG", false},
+		{"#f808", "JPEG", false},
+		{"none", "JPEG", false},
+	}
+
+	for _, test := range tests {
+		err := ip.ValidateOptions(&ImageProcessorOptions{Background: test.background, OutputFormat: test.format})
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("bg=%s fmt=%s: got error %v", test.background, test.format, err)
+		}
+		if err != nil && !IsImageErrorKind(err, ErrorKindBadOptions) {
+			t.Errorf("bg=%s fmt=%s: got error %v, expected bad options", test.background, test.format, err)
+		}
+	}
+}
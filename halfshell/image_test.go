@@ -0,0 +1,96 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestImageLimitsCheck(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 300, 200))
+	var pngData, jpegData, gifData bytes.Buffer
+	if err := png.Encode(&pngData, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(&jpegData, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := gif.Encode(&gifData, m, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		limits   ImageLimits
+		exceeded bool
+	}{
+		{ImageLimits{}, false},
+		{ImageLimits{MaxPixels: 60000, MaxWidth: 300, MaxHeight: 200}, false},
+		{ImageLimits{MaxPixels: 59999}, true},
+		{ImageLimits{MaxWidth: 299}, true},
+		{ImageLimits{MaxHeight: 199}, true},
+	}
+
+	for _, data := range [][]byte{pngData.Bytes(), jpegData.Bytes(), gifData.Bytes()} {
+		for _, test := range tests {
+			err := test.limits.check(data)
+			if exceeded := IsImageErrorKind(err, ErrorKindLimitExceeded); exceeded != test.exceeded {
+				t.Errorf("%+v: got error %v, expected limit exceeded to be %t", test.limits, err, test.exceeded)
+			}
+		}
+	}
+
+	// Images whose headers can't be read are checked once decoded.
+	limits := ImageLimits{MaxPixels: 1}
+	if err := limits.check([]byte("RIFF\x00\x00\x00\x00WEBPVP8 ")); err != nil {
+		t.Errorf("got error %v for unreadable header, expected none", err)
+	}
+}
+
+func TestParseCropRegion(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected CropRegion
+	}{
+		{"10,20,300,200", CropRegion{10, 20, 300, 200, false}},
+		{"0.1, 0.2, 0.5, 0.5", CropRegion{0.1, 0.2, 0.5, 0.5, true}},
+		{"0.25,0.0,0.5,1.0", CropRegion{0.25, 0, 0.5, 1, true}},
+	}
+
+	for _, test := range tests {
+		region, err := ParseCropRegion(test.s)
+		if err != nil {
+			t.Errorf("%s: got error %v", test.s, err)
+		} else if region != test.expected {
+			t.Errorf("%s: got %+v, expected %+v", test.s, region, test.expected)
+		}
+	}
+
+	for _, s := range []string{"", "10,20,300", "10,20,300,200,1", "a,b,c,d", "10,10,0.5,0.5", "0.25,0,0.5,1"} {
+		if _, err := ParseCropRegion(s); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	pathOptionsDimensionsPattern = regexp.MustCompile(`^(\d*)x(\d*)$`)
+	pathOptionsFilterPattern     = regexp.MustCompile(`^(\w+)\((.*)\)$`)
+)
+
+// pathOptionsScaleModeAliases maps Thumbor scale mode segments to the
+// equivalent scale modes.
+var pathOptionsScaleModeAliases = map[string]string{
+	"fit-in": "aspect_fit",
+}
+
+// pathOptionsFilterParams maps the filters accepted in the filters segment to
+// the equivalent query parameters.
+var pathOptionsFilterParams = map[string]string{
+	"bg":         "bg",
+	"blur":       "blur",
+	"crop":       "crop",
+	"focalpoint": "focalpoint",
+	"format":     "fmt",
+	"quality":    "q",
+	"preset":     "format",
+	"scale_mode": "scale_mode",
+}
+
+// ParsePathOptions parses processing options encoded as segments at the
+// beginning of path, in the style of Thumbor. It returns the remaining path of
+// the image and the options as the equivalent query parameters. For example,
+// the path:
+//
+//	/300x200/aspect_crop/filters:blur(0.2):format(webp)/photos/joe.jpg
+//
+// is parsed into the image path /photos/joe.jpg and the query parameters
+// w=300&h=200&scale_mode=aspect_crop&blur=0.2&fmt=webp. Option segments may be
+// given in any order. A smart segment enables smart cropping. The image path
+// begins at the first segment that isn't an option.
+func ParsePathOptions(path string) (string, url.Values) {
+	params := url.Values{}
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+	i := 0
+	for ; i < len(segments)-1; i++ {
+		segment := segments[i]
+
+		if matches := pathOptionsDimensionsPattern.FindStringSubmatch(segment); matches != nil && segment != "x" {
+			if matches[1] != "" {
+				params.Set("w", matches[1])
+			}
+			if matches[2] != "" {
+				params.Set("h", matches[2])
+			}
+			continue
+		}
+
+		if segment == "smart" {
+			params.Add("crop", "smart")
+			continue
+		}
+
+		if scaleModeName, ok := pathOptionsScaleModeAliases[segment]; ok {
+			params.Set("scale_mode", scaleModeName)
+			continue
+		}
+
+		if _, ok := ScaleModes[segment]; ok {
+			params.Set("scale_mode", segment)
+			continue
+		}
+
+		if strings.HasPrefix(segment, "filters:") {
+			for _, filter := range strings.Split(strings.TrimPrefix(segment, "filters:"), ":") {
+				matches := pathOptionsFilterPattern.FindStringSubmatch(filter)
+				if matches == nil {
+					continue
+				}
+				param, ok := pathOptionsFilterParams[matches[1]]
+				if !ok {
+					continue
+				}
+				// Crop regions are combined with smart cropping.
+				if param == "crop" {
+					params.Add(param, matches[2])
+				} else {
+					params.Set(param, matches[2])
+				}
+			}
+			continue
+		}
+
+		break
+	}
+
+	return "/" + strings.Join(segments[i:], "/"), params
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParsePathOptions(t *testing.T) {
+	tests := []struct {
+		path      string
+		imagePath string
+		params    url.Values
+	}{
+		{
+			"/300x200/smart/filters:blur(0.2)/image_path",
+			"/image_path",
+			url.Values{"w": {"300"}, "h": {"200"}, "crop": {"smart"}, "blur": {"0.2"}},
+		},
+		{
+			"/300x200/aspect_crop/filters:blur(0.2):format(webp)/photos/joe.jpg",
+			"/photos/joe.jpg",
+			url.Values{"w": {"300"}, "h": {"200"}, "scale_mode": {"aspect_crop"}, "blur": {"0.2"}, "fmt": {"webp"}},
+		},
+		{
+			"/fit-in/x200/photos/joe.jpg",
+			"/photos/joe.jpg",
+			url.Values{"h": {"200"}, "scale_mode": {"aspect_fit"}},
+		},
+		{
+			"/smart/filters:crop(10,20,300,200):focalpoint(0.1,0.2)/joe.jpg",
+			"/joe.jpg",
+			url.Values{"crop": {"smart", "10,20,300,200"}, "focalpoint": {"0.1,0.2"}},
+		},
+		{
+			"/photos/smart/joe.jpg",
+			"/photos/smart/joe.jpg",
+			url.Values{},
+		},
+		{
+			"/smart",
+			"/smart",
+			url.Values{},
+		},
+	}
+
+	for _, test := range tests {
+		imagePath, params := ParsePathOptions(test.path)
+		if imagePath != test.imagePath {
+			t.Errorf("%s: got image path %s, expected %s", test.path, imagePath, test.imagePath)
+		}
+		if !reflect.DeepEqual(params, test.params) {
+			t.Errorf("%s: got params %v, expected %v", test.path, params, test.params)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+const DefaultMaxRedirects = 5
+
+// DefaultAllowedSchemes lists the schemes of remote URLs that are allowed
+// when a source doesn't specify any.
+var DefaultAllowedSchemes = []string{"http", "https"}
+
+// deniedNetworks lists the IP ranges that remote URLs may not resolve to:
+// private, shared, loopback, link-local, benchmarking, documentation, multicast
+// and otherwise reserved ranges.
+var deniedNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// errURLNotAllowed is returned when a remote URL, or the address it resolves
+// to, isn't allowed by the source's policy.
+var errURLNotAllowed = errors.New("URL not allowed")
+
+// RemoteURLPolicy restricts the remote URLs that a source may retrieve images
+// from, to protect against server-side request forgery.
+type RemoteURLPolicy struct {
+	AllowedHosts         []string
+	AllowedSchemes       []string
+	MaxRedirects         int
+	AllowPrivateNetworks bool
+}
+
+// NewRemoteURLPolicyWithConfig returns the remote URL policy of the source.
+func NewRemoteURLPolicyWithConfig(config *SourceConfig) *RemoteURLPolicy {
+	policy := &RemoteURLPolicy{
+		AllowedHosts:         config.AllowedHosts,
+		AllowedSchemes:       config.AllowedSchemes,
+		MaxRedirects:         int(config.MaxRedirects),
+		AllowPrivateNetworks: config.AllowPrivateNetworks,
+	}
+	if len(policy.AllowedSchemes) == 0 {
+		policy.AllowedSchemes = DefaultAllowedSchemes
+	}
+	if policy.MaxRedirects == 0 {
+		policy.MaxRedirects = DefaultMaxRedirects
+	}
+	return policy
+}
+
+// ParseURL parses a remote URL given as an image path, e.g.
+// /https://example.com/image.jpg, and checks that it's allowed.
+func (p *RemoteURLPolicy) ParseURL(path string) (*url.URL, error) {
+	rawURL := strings.TrimPrefix(path, "/")
+	// Proxies may merge the slashes following the scheme.
+	if i := strings.Index(rawURL, ":/"); i != -1 && !strings.HasPrefix(rawURL[i:], "://") {
+		rawURL = rawURL[:i] + "://" + rawURL[i+2:]
+	}
+
+	remoteURL, err := url.Parse(rawURL)
+	if err != nil || remoteURL.Host == "" {
+		return nil, NewImageError(ErrorKindBadOptions, err, "Invalid image URL")
+	}
+	if err := p.CheckURL(remoteURL); err != nil {
+		return nil, err
+	}
+	return remoteURL, nil
+}
+
+// CheckURL returns an error if the scheme or host of the URL isn't allowed.
+func (p *RemoteURLPolicy) CheckURL(remoteURL *url.URL) error {
+	if remoteURL.User != nil {
+		return NewImageError(ErrorKindURLNotAllowed,
+			fmt.Errorf("%w: %s has credentials", errURLNotAllowed, remoteURL.Host), "Image URL not allowed")
+	}
+	if !p.schemeAllowed(remoteURL.Scheme) {
+		return NewImageError(ErrorKindURLNotAllowed,
+			fmt.Errorf("%w: scheme %s", errURLNotAllowed, remoteURL.Scheme), "Image URL not allowed")
+	}
+	if !p.hostAllowed(remoteURL.Hostname()) {
+		return NewImageError(ErrorKindURLNotAllowed,
+			fmt.Errorf("%w: host %s", errURLNotAllowed, remoteURL.Hostname()), "Image URL not allowed")
+	}
+	return nil
+}
+
+func (p *RemoteURLPolicy) schemeAllowed(scheme string) bool {
+	for _, allowedScheme := range p.AllowedSchemes {
+		if strings.EqualFold(scheme, allowedScheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostAllowed returns a bool indicating whether the host matches one of the
+// allowed host patterns. A pattern beginning with "*." matches all subdomains
+// of the domain, and "*" matches all hosts.
+func (p *RemoteURLPolicy) hostAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.AllowedHosts {
+		pattern = strings.ToLower(pattern)
+		switch {
+		case pattern == "*", pattern == host:
+			return true
+		case strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// CheckRedirect limits the number of redirects and checks that the URLs
+// redirected to are allowed. It's used as the CheckRedirect function of the
+// source's HTTP client.
+func (p *RemoteURLPolicy) CheckRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) > p.MaxRedirects {
+		return NewImageError(ErrorKindURLNotAllowed,
+			fmt.Errorf("%w: more than %d redirects", errURLNotAllowed, p.MaxRedirects), "Too many redirects")
+	}
+	return p.CheckURL(request.URL)
+}
+
+// Control rejects connections to denied IP ranges. It's used as the Control
+// function of the source's dialer, so that addresses are checked after DNS
+// resolution, for every connection including those of redirects.
+func (p *RemoteURLPolicy) Control(network, address string, c syscall.RawConn) error {
+	if p.AllowPrivateNetworks {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: invalid address %s", errURLNotAllowed, address)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range deniedNetworks {
+		if network.Contains(ip) {
+			return fmt.Errorf("%w: address %s", errURLNotAllowed, ip)
+		}
+	}
+	return nil
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestRemoteURLPolicyControl(t *testing.T) {
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"0.1.2.3", false},
+		{"10.1.2.3", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"172.16.0.1", false},
+		{"192.0.0.1", false},
+		{"192.0.2.1", false},
+		{"192.0.2.255", false},
+		{"192.168.1.1", false},
+		{"198.18.0.1", false},
+		{"198.19.255.254", false},
+		{"198.51.100.1", false},
+		{"198.51.100.255", false},
+		{"203.0.113.1", false},
+		{"203.0.113.255", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::", false},
+		{"::1", false},
+		{"::ffff:10.1.2.3", false},
+		{"::ffff:203.0.113.1", false},
+		{"64:ff9b::a01:203", false},
+		{"2001:db8::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+		{"8.8.8.8", true},
+		{"100.63.255.255", true},
+		{"100.128.0.1", true},
+		{"192.0.3.1", true},
+		{"198.20.0.1", true},
+		{"198.51.101.1", true},
+		{"203.0.114.1", true},
+		{"2606:4700::1111", true},
+	}
+
+	policy := &RemoteURLPolicy{}
+	for _, test := range tests {
+		err := policy.Control("tcp", net.JoinHostPort(test.ip, "443"), nil)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%s: got error %v, expected allowed to be %t", test.ip, err, test.allowed)
+		}
+		if err != nil && !errors.Is(err, errURLNotAllowed) {
+			t.Errorf("%s: got error %v, expected %v", test.ip, err, errURLNotAllowed)
+		}
+	}
+
+	policy = &RemoteURLPolicy{AllowPrivateNetworks: true}
+	if err := policy.Control("tcp", "10.1.2.3:443", nil); err != nil {
+		t.Errorf("got error %v with private networks allowed", err)
+	}
+}
@@ -21,9 +21,28 @@
 package halfshell
 
 import (
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"regexp"
 	"strconv"
+	"strings"
+)
+
+// AutoOutputFormats lists the formats, in order of preference, that images are
+// converted to when the processor enables auto_format and the client
+// advertises support for them in the Accept header.
+var AutoOutputFormats = []string{"avif", "webp"}
+
+const (
+	// OptionsSyntaxQuery reads processing options from the query string, e.g.
+	// /image.jpg?w=300&h=200.
+	OptionsSyntaxQuery = "query"
+	// OptionsSyntaxPath reads processing options from path segments preceding
+	// the image path, e.g. /300x200/aspect_crop/image.jpg.
+	OptionsSyntaxPath = "path"
 )
 
 // A Route handles the business logic of a Halfshell request. It contains a
@@ -33,63 +52,218 @@ import (
 type Route struct {
 	Name           string
 	Pattern        *regexp.Regexp
+	Host           string
 	ImagePathIndex int
+	OptionsSyntax  string
 	Processor      ImageProcessor
+	ImageLimits    *ImageLimits
 	Formats        map[string]FormatConfig
+	OutputFormats  []string
+	AutoFormat     bool
 	Source         ImageSource
+	Fallback       string
+	FallbackSource ImageSource
 	CacheControl   string
+	SigningKeys    []string
+	Caches         []ImageCache
 	Statter        Statter
 }
 
 // NewRouteWithConfig returns a pointer to a new Route instance created using
 // the provided configuration settings.
 func NewRouteWithConfig(config *RouteConfig, statterConfig *StatterConfig) *Route {
-	return &Route{
+	statter := NewStatterWithConfig(config, statterConfig)
+	imageLimits := &ImageLimits{
+		MaxPixels: config.ProcessorConfig.MaxInputPixels,
+		MaxWidth:  config.ProcessorConfig.MaxInputWidth,
+		MaxHeight: config.ProcessorConfig.MaxInputHeight,
+	}
+	caches, err := NewImageCachesWithConfig(config, statter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create caches for route %s: %v\n", config.Name, err)
+		os.Exit(1)
+	}
+	route := &Route{
 		Name:           config.Name,
 		Pattern:        config.Pattern,
+		Host:           config.Host,
 		ImagePathIndex: config.ImagePathIndex,
+		OptionsSyntax:  config.OptionsSyntax,
 		CacheControl:   config.CacheControl,
+		SigningKeys:    config.SigningKeys,
 		Processor:      NewImageProcessorWithConfig(config.ProcessorConfig),
+		ImageLimits:    imageLimits,
 		Formats:        config.ProcessorConfig.Formats,
-		Source:         NewImageSourceWithConfig(config.SourceConfig),
-		Statter:        NewStatterWithConfig(config, statterConfig),
+		OutputFormats:  config.ProcessorConfig.OutputFormats,
+		AutoFormat:     config.ProcessorConfig.AutoFormat,
+		Source:         CoalescingImageSourceForConfig(config.SourceConfig),
+		Caches:         caches,
+		Statter:        statter,
+		Fallback:       config.Fallback,
+	}
+
+	if config.FallbackSourceConfig != nil {
+		route.FallbackSource = CoalescingImageSourceForConfig(config.FallbackSourceConfig)
 	}
+
+	return route
 }
 
 // ShouldHandleRequest accepts an HTTP request and returns a bool indicating
 // whether the route should handle the request.
 func (p *Route) ShouldHandleRequest(r *http.Request) bool {
-	return p.Pattern.MatchString(r.URL.Path)
+	return p.matchesHost(r.Host) && p.Pattern.MatchString(r.URL.Path)
+}
+
+// matchesHost returns a bool indicating whether the request host matches the
+// route's host. A route without a host matches all hosts. A host beginning
+// with "*." matches all of its subdomains.
+func (p *Route) matchesHost(host string) bool {
+	if p.Host == "" {
+		return true
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(host)
+	if strings.HasPrefix(p.Host, "*.") {
+		return strings.HasSuffix(host, p.Host[1:])
+	}
+	return host == p.Host
+}
+
+// IsAuthorized returns a bool indicating whether the request is allowed to
+// be handled by the route. If the route has signing keys, the request URL must
+// be signed with one of them.
+func (p *Route) IsAuthorized(r *http.Request) bool {
+	return len(p.SigningKeys) == 0 || ValidURLSignature(p.SigningKeys, r.URL)
 }
 
 // SourceAndProcessorOptionsForRequest parses the source and processor options
-// from the request.
+// from the request. An error of kind ErrorKindBadOptions is returned along
+// with the options if an option is malformed.
 func (p *Route) SourceAndProcessorOptionsForRequest(r *http.Request) (
-	*ImageSourceOptions, *ImageProcessorOptions) {
+	*ImageSourceOptions, *ImageProcessorOptions, error) {
 
 	matches := p.Pattern.FindAllStringSubmatch(r.URL.Path, -1)[0]
 	path := matches[p.ImagePathIndex]
 
+	var params url.Values
+	if p.OptionsSyntax == OptionsSyntaxPath {
+		path, params = ParsePathOptions(path)
+	} else {
+		r.ParseForm()
+		params = r.Form
+	}
+
+	processorOptions, err := p.processorOptionsForParams(params)
+	return &ImageSourceOptions{Path: path, Limits: p.ImageLimits}, processorOptions, err
+}
+
+// processorOptionsForParams creates processor options from request
+// parameters, regardless of the syntax they were specified in. Most malformed
+// parameters are ignored, but malformed crop regions and background colors are
+// returned as errors, since ignoring them would silently change the image.
+func (p *Route) processorOptionsForParams(params url.Values) (*ImageProcessorOptions, error) {
 	var width, height uint64
 	var blurRadius float64
-	if formatName := r.FormValue("format"); formatName == "" {
-		width, _ = strconv.ParseUint(r.FormValue("w"), 10, 32)
-		height, _ = strconv.ParseUint(r.FormValue("h"), 10, 32)
-		blurRadius, _ = strconv.ParseFloat(r.FormValue("blur"), 64)
+	if formatName := params.Get("format"); formatName == "" {
+		width, _ = strconv.ParseUint(params.Get("w"), 10, 32)
+		height, _ = strconv.ParseUint(params.Get("h"), 10, 32)
+		blurRadius, _ = strconv.ParseFloat(params.Get("blur"), 64)
 	} else {
 		width = p.Formats[formatName].Width
 		height = p.Formats[formatName].Height
 		blurRadius = p.Formats[formatName].Blur
 	}
 
-	focalpoint := r.FormValue("focalpoint")
-	scaleModeName := r.FormValue("scale_mode")
+	var focalpoint *Focalpoint
+	focalpointParam := params.Get("focalpoint")
+	if fp, err := ParseFocalpoint(focalpointParam); err == nil {
+		focalpoint = &fp
+	}
+	// The crop parameter may be given twice to combine smart cropping with a
+	// crop region.
+	smartCrop := focalpointParam == "auto"
+	var cropRegion *CropRegion
+	var err error
+	for _, crop := range params["crop"] {
+		if crop == "smart" {
+			smartCrop = true
+			continue
+		}
+		region, parseErr := ParseCropRegion(crop)
+		if parseErr != nil {
+			err = NewImageError(ErrorKindBadOptions, parseErr, "Invalid crop region %s", crop)
+			continue
+		}
+		cropRegion = &region
+	}
+
+	var background string
+	if bg := params.Get("bg"); bg != "" {
+		var parseErr error
+		background, parseErr = ParseColor(bg)
+		if parseErr != nil {
+			err = NewImageError(ErrorKindBadOptions, parseErr, "Invalid background color %s", bg)
+		}
+	}
+	scaleModeName := params.Get("scale_mode")
 	scaleMode, _ := ScaleModes[scaleModeName]
+	outputFormat := p.outputFormatForName(params.Get("fmt"))
+	quality, _ := strconv.ParseUint(params.Get("q"), 10, 32)
+
+	return &ImageProcessorOptions{
+		Dimensions:   ImageDimensions{uint(width), uint(height)},
+		BlurRadius:   blurRadius,
+		ScaleMode:    uint(scaleMode),
+		Focalpoint:   focalpoint,
+		SmartCrop:    smartCrop,
+		CropRegion:   cropRegion,
+		Background:   background,
+		OutputFormat: outputFormat,
+		Quality:      uint(quality),
+	}, err
+}
+
+// outputFormatForName returns the ImageMagick format for the requested output
+// format name. An empty string is returned if the format is unknown or not
+// allowed by the processor, in which case the source format is retained.
+func (p *Route) outputFormatForName(name string) string {
+	format := ImageFormats[strings.ToLower(name)]
+	if format == "" || len(p.OutputFormats) == 0 {
+		return format
+	}
+	for _, allowedFormat := range p.OutputFormats {
+		if allowedFormat == format {
+			return format
+		}
+	}
+	return ""
+}
+
+// OutputFormatForAccept returns the preferred output format accepted by the
+// client according to the given Accept header. An empty string is returned if
+// the client doesn't accept any of the AutoOutputFormats.
+func (p *Route) OutputFormatForAccept(accept string) string {
+	acceptedMIMETypes := make(map[string]bool)
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		mimeType := strings.ToLower(strings.TrimSpace(params[0]))
+		acceptedMIMETypes[mimeType] = true
+		for _, param := range params[1:] {
+			param = strings.Replace(param, " ", "", -1)
+			if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil && q == 0 {
+				acceptedMIMETypes[mimeType] = false
+			}
+		}
+	}
 
-	return &ImageSourceOptions{Path: path}, &ImageProcessorOptions{
-		Dimensions: ImageDimensions{uint(width), uint(height)},
-		BlurRadius: blurRadius,
-		ScaleMode:  uint(scaleMode),
-		Focalpoint: NewFocalpointFromString(focalpoint),
+	for _, formatName := range AutoOutputFormats {
+		format := p.outputFormatForName(formatName)
+		if format != "" && acceptedMIMETypes[imageFormatMIMETypes[format]] {
+			return format
+		}
 	}
+	return ""
 }
@@ -21,16 +21,22 @@
 package halfshell
 
 import (
+	"crypto/sha1"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
 type Server struct {
 	*http.Server
-	Routes []*Route
-	Logger *Logger
+	Routes     []*Route
+	Logger     *Logger
+	JSONErrors bool
+	flight     flightGroup
 }
 
 func NewServerWithConfigAndRoutes(config *ServerConfig, routes []*Route) *Server {
@@ -40,7 +46,12 @@ func NewServerWithConfigAndRoutes(config *ServerConfig, routes []*Route) *Server
 		WriteTimeout:   time.Duration(config.WriteTimeout) * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
-	server := &Server{httpServer, routes, NewLogger("server")}
+	server := &Server{
+		Server:     httpServer,
+		Routes:     routes,
+		Logger:     NewLogger("server"),
+		JSONErrors: config.JSONErrors,
+	}
 	httpServer.Handler = server
 	return server
 }
@@ -66,32 +77,190 @@ func (s *Server) ImageRequestHandler(w *ResponseWriter, r *Request) {
 
 	defer func() { go r.Route.Statter.RegisterRequest(w, r) }()
 
-	s.Logger.Infof("Handling request for image %s with dimensions %v",
-		r.SourceOptions.Path, r.ProcessorOptions.Dimensions)
-
-	image, err := r.Route.Source.GetImage(r.SourceOptions)
-	if err != nil {
-		w.WriteError("Not Found", http.StatusNotFound)
+	if !r.Route.IsAuthorized(r.Request) {
+		w.WriteError("Forbidden", http.StatusForbidden)
 		return
 	}
-	defer image.Destroy()
 
-	err = r.Route.Processor.ProcessImage(image, r.ProcessorOptions)
+	err := r.OptionsError
+	if err == nil {
+		err = r.Route.Processor.ValidateOptions(r.ProcessorOptions)
+	}
 	if err != nil {
-		s.Logger.Warnf("Error processing image data %s to dimensions: %v", r.ProcessorOptions.Dimensions)
-		w.WriteError("Internal Server Error", http.StatusNotFound)
+		s.WriteImageError(w, r, err)
 		return
 	}
 
-	s.Logger.Infof("Returning resized image %s to dimensions %v",
-		r.SourceOptions.Path, r.ProcessorOptions.Dimensions)
+	if r.Route.AutoFormat {
+		w.SetHeader("Vary", "Accept")
+		if r.ProcessorOptions.OutputFormat == "" {
+			r.ProcessorOptions.OutputFormat = r.Route.OutputFormatForAccept(r.Header.Get("Accept"))
+		}
+	}
 
 	cacheControl := r.Route.CacheControl
 	if r.Route.CacheControl == "" {
 		cacheControl = "no-transform,public,max-age=86400,s-maxage=2592000"
 	}
+
+	cacheKey := r.CacheKey()
+	encodedImage := s.cachedImage(r, cacheKey)
+
+	// Sources that can check the version of the original image cheaply allow
+	// conditional requests to be answered without retrieving the image.
+	// Otherwise, the ETag is computed from the retrieved image below.
+	if encodedImage == nil && r.IsConditional() {
+		if metadataSource, ok := r.Route.Source.(ImageMetadataSource); ok {
+			metadata, err := metadataSource.GetImageMetadata(r.SourceOptions)
+			if err == nil {
+				etag := imageETag(r, r.SourceOptions, metadata)
+				if r.NotModified(etag, metadata.LastModified) {
+					s.Logger.Infof("Image %s not modified", r.SourceOptions.Path)
+					w.SetHeader("Cache-Control", cacheControl)
+					w.WriteNotModified(etag, metadata.LastModified)
+					return
+				}
+			}
+		}
+	}
+
+	if encodedImage == nil {
+		// Concurrent requests for the same processed image share the result of
+		// a single request.
+		value, _, err := s.flight.Do(cacheKey, func() (interface{}, error) {
+			encodedImage, err := s.renderImage(r, r.Route.Source, r.SourceOptions)
+			if err != nil {
+				return nil, err
+			}
+			for _, cache := range r.Route.Caches {
+				cache.Set(cacheKey, encodedImage)
+			}
+			return encodedImage, nil
+		})
+		if IsImageErrorKind(err, ErrorKindNotFound) && r.Route.Fallback != "" {
+			value, err = s.renderFallbackImage(r)
+			if err == nil {
+				w.SetHeader("X-Halfshell-Fallback", "1")
+				cacheControl = "no-cache"
+			}
+		}
+		if err != nil {
+			s.WriteImageError(w, r, err)
+			return
+		}
+		encodedImage = value.(*EncodedImage)
+	}
+
+	if r.NotModified(encodedImage.ETag, encodedImage.LastModified) {
+		s.Logger.Infof("Image %s not modified", r.SourceOptions.Path)
+		w.SetHeader("Cache-Control", cacheControl)
+		w.WriteNotModified(encodedImage.ETag, encodedImage.LastModified)
+		return
+	}
+
+	s.Logger.Infof("Returning resized image %s to dimensions %v",
+		r.SourceOptions.Path, r.ProcessorOptions.Dimensions)
+
 	w.SetHeader("Cache-Control", cacheControl)
-	w.WriteImage(image)
+	w.WriteImage(encodedImage)
+}
+
+// renderImage retrieves the image from the source, processes it with the
+// request's processing options, and returns the encoded result.
+func (s *Server) renderImage(r *Request, source ImageSource, sourceOptions *ImageSourceOptions) (
+	*EncodedImage, error) {
+
+	s.Logger.Infof("Handling request for image %s with dimensions %v",
+		sourceOptions.Path, r.ProcessorOptions.Dimensions)
+
+	image, err := source.GetImage(sourceOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer image.Destroy()
+
+	if image.Metadata.Source != "" {
+		r.Route.Statter.Increment(fmt.Sprintf("source.%s", image.Metadata.Source))
+	}
+
+	etag := imageETag(r, sourceOptions, &image.Metadata)
+
+	err = r.Route.Processor.ProcessImage(image, r.ProcessorOptions)
+	if err != nil {
+		s.Logger.Warnf("Error processing image data %s to dimensions %v: %v",
+			sourceOptions.Path, r.ProcessorOptions.Dimensions, err)
+		return nil, err
+	}
+
+	if etag == "" {
+		etag = image.GetSignature()
+	}
+
+	return image.Encode(etag), nil
+}
+
+// renderFallbackImage renders the route's fallback image with the request's
+// processing options. Fallback images aren't cached, since the original image
+// may become available, but concurrent requests for the same fallback image
+// are coalesced.
+func (s *Server) renderFallbackImage(r *Request) (interface{}, error) {
+	s.Logger.Infof("Image %s not found, using fallback image %s",
+		r.SourceOptions.Path, r.Route.Fallback)
+	r.Route.Statter.Increment("fallback")
+
+	fallbackOptions := &ImageSourceOptions{Path: r.Route.Fallback, Limits: r.SourceOptions.Limits}
+	fallbackKey := fmt.Sprintf("%s:fallback:%s?%s", r.Route.Name, r.Route.Fallback, r.ProcessorOptions)
+	value, _, err := s.flight.Do(fallbackKey, func() (interface{}, error) {
+		return s.renderImage(r, r.Route.FallbackSource, fallbackOptions)
+	})
+	return value, err
+}
+
+// WriteImageError writes the error response for an error that occurred while
+// retrieving or processing an image and reports it to StatsD.
+func (s *Server) WriteImageError(w *ResponseWriter, r *Request, err error) {
+	imageError := ImageErrorFromError(err)
+	r.Route.Statter.Increment(fmt.Sprintf("errors.%s", imageError.Kind))
+	w.WriteImageError(imageError)
+}
+
+// cachedImage looks up the processed image in the route's caches, in order.
+// When found, the image is also stored in the caches preceding the one it was
+// found in. Returns nil if none of the caches contain the image.
+func (s *Server) cachedImage(r *Request, cacheKey string) *EncodedImage {
+	for i, cache := range r.Route.Caches {
+		if encodedImage, ok := cache.Get(cacheKey); ok {
+			for _, previousCache := range r.Route.Caches[:i] {
+				previousCache.Set(cacheKey, encodedImage)
+			}
+			return encodedImage
+		}
+	}
+	return nil
+}
+
+// imageETag returns an ETag for the processed image derived from the version
+// of the original image and the processing options. This allows the ETag to
+// be computed without retrieving or processing the image. An empty string is
+// returned if the version of the original image is unknown.
+func imageETag(r *Request, sourceOptions *ImageSourceOptions, metadata *ImageMetadata) string {
+	version := metadata.ETag
+	if version == "" && !metadata.LastModified.IsZero() {
+		version = metadata.LastModified.UTC().Format(http.TimeFormat)
+	}
+	if version == "" {
+		return ""
+	}
+
+	hash := sha1.New()
+	io.WriteString(hash, r.Route.Name+"\n")
+	io.WriteString(hash, sourceOptions.Path+"\n")
+	io.WriteString(hash, version+"\n")
+	if metadata.Focalpoint != nil {
+		io.WriteString(hash, "focalpoint="+metadata.Focalpoint.String()+"\n")
+	}
+	io.WriteString(hash, r.ProcessorOptions.String())
+	return fmt.Sprintf("\"%x\"", hash.Sum(nil))
 }
 
 func (s *Server) LogRequest(w *ResponseWriter, r *Request) {
@@ -110,35 +279,76 @@ type Request struct {
 	Route            *Route
 	SourceOptions    *ImageSourceOptions
 	ProcessorOptions *ImageProcessorOptions
+	// OptionsError is the error parsing the processing options, if any.
+	OptionsError error
 }
 
 func (s *Server) NewRequest(r *http.Request) *Request {
-	request := &Request{r, time.Now(), nil, nil, nil}
+	request := &Request{Request: r, Timestamp: time.Now()}
 	for _, route := range s.Routes {
 		if route.ShouldHandleRequest(r) {
 			request.Route = route
+			break
 		}
 	}
 
 	if request.Route != nil {
-		request.SourceOptions, request.ProcessorOptions =
+		request.SourceOptions, request.ProcessorOptions, request.OptionsError =
 			request.Route.SourceAndProcessorOptionsForRequest(r)
 	}
 
 	return request
 }
 
+// CacheKey returns the key identifying the processed image in caches. Requests
+// for the same image with equivalent processing options have the same key.
+func (r *Request) CacheKey() string {
+	return fmt.Sprintf("%s:%s?%s", r.Route.Name, r.SourceOptions.Path, r.ProcessorOptions)
+}
+
+// IsConditional returns a bool indicating whether the request has an
+// If-None-Match or If-Modified-Since header.
+func (r *Request) IsConditional() bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+// NotModified returns a bool indicating whether the client's cached copy of
+// the image, as described by the request's conditional headers, is still
+// current given the image's ETag and modification time.
+func (r *Request) NotModified(etag string, lastModified time.Time) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ifModifiedSince)
+		return err == nil && !lastModified.Truncate(time.Second).After(t)
+	}
+
+	return false
+}
+
 // ResponseWriter is a wrapper around http.ResponseWriter that provides
 // access to the response status and size after they have been set.
 type ResponseWriter struct {
-	w      http.ResponseWriter
-	Status int
-	Size   int
+	w          http.ResponseWriter
+	Status     int
+	Size       int
+	JSONErrors bool
 }
 
 // NewResponseWriter creates a new ResponseWriter by wrapping http.ResponseWriter.
 func (s *Server) NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
-	return &ResponseWriter{w: w}
+	return &ResponseWriter{w: w, JSONErrors: s.JSONErrors}
 }
 
 // WriteHeader forwards to http.ResponseWriter's WriteHeader method.
@@ -160,17 +370,54 @@ func (hw *ResponseWriter) Write(data []byte) (int, error) {
 
 // WriteError writes an error response.
 func (hw *ResponseWriter) WriteError(message string, status int) {
+	kind := strings.Replace(strings.ToLower(http.StatusText(status)), " ", "_", -1)
+	hw.writeError(kind, message, status)
+}
+
+// WriteImageError writes the error response for an ImageError.
+func (hw *ResponseWriter) WriteImageError(err *ImageError) {
+	hw.writeError(string(err.Kind), err.Message, err.StatusCode())
+}
+
+// writeError writes an error response as plain text, or as a JSON object with
+// status, error and message fields if JSONErrors is set.
+func (hw *ResponseWriter) writeError(kind, message string, status int) {
+	if hw.JSONErrors {
+		body, _ := json.Marshal(struct {
+			Status  int    `json:"status"`
+			Error   string `json:"error"`
+			Message string `json:"message"`
+		}{status, kind, message})
+		hw.SetHeader("Content-Type", "application/json; charset=utf-8")
+		hw.WriteHeader(status)
+		hw.Write(body)
+		return
+	}
+
 	hw.SetHeader("Content-Type", "text/plain; charset=utf-8")
 	hw.WriteHeader(status)
 	hw.Write([]byte(message))
 }
 
 // WriteImage writes an image to the output stream and sets the appropriate headers.
-func (hw *ResponseWriter) WriteImage(image *Image) {
-	bytes, size := image.GetBytes()
-	hw.SetHeader("Content-Type", image.GetMIMEType())
-	hw.SetHeader("Content-Length", fmt.Sprintf("%d", size))
-	hw.SetHeader("ETag", image.GetSignature())
+func (hw *ResponseWriter) WriteImage(image *EncodedImage) {
+	hw.SetHeader("Content-Type", image.ContentType)
+	hw.SetHeader("Content-Length", fmt.Sprintf("%d", len(image.Bytes)))
+	hw.SetHeader("ETag", image.ETag)
+	if !image.LastModified.IsZero() {
+		hw.SetHeader("Last-Modified", image.LastModified.UTC().Format(http.TimeFormat))
+	}
 	hw.WriteHeader(http.StatusOK)
-	hw.Write(bytes)
+	hw.Write(image.Bytes)
+}
+
+// WriteNotModified writes a 304 Not Modified response.
+func (hw *ResponseWriter) WriteNotModified(etag string, lastModified time.Time) {
+	if etag != "" {
+		hw.SetHeader("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		hw.SetHeader("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	hw.WriteHeader(http.StatusNotModified)
 }
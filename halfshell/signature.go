@@ -0,0 +1,79 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// SignatureParam is the query parameter holding the signature of a URL.
+const SignatureParam = "sig"
+
+// SignURL signs the path and query parameters of an image URL with key and
+// returns the escaped path and query string, including the signature, to
+// request the image from a route that requires signed URLs. For example:
+//
+//	SignURL(key, "/users/joe/default.jpg", url.Values{"w": {"100"}})
+func SignURL(key, path string, query url.Values) string {
+	signedQuery := url.Values{}
+	for name, values := range query {
+		signedQuery[name] = values
+	}
+	signedQuery.Set(SignatureParam, URLSignature(key, path, query))
+	return (&url.URL{Path: path}).EscapedPath() + "?" + signedQuery.Encode()
+}
+
+// URLSignature returns the signature of a URL's path and query parameters,
+// which is the base64 encoded HMAC-SHA256 of the path and the sorted query
+// parameters other than the signature itself.
+func URLSignature(key, path string, query url.Values) string {
+	signedQuery := url.Values{}
+	for name, values := range query {
+		if name != SignatureParam {
+			signedQuery[name] = values
+		}
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	io.WriteString(mac, path+"?"+signedQuery.Encode())
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(mac.Sum(nil)), "=")
+}
+
+// ValidURLSignature returns a bool indicating whether the URL is signed with
+// any of the keys.
+func ValidURLSignature(keys []string, u *url.URL) bool {
+	query := u.Query()
+	signature := query.Get(SignatureParam)
+	if signature == "" {
+		return false
+	}
+	for _, key := range keys {
+		if hmac.Equal([]byte(signature), []byte(URLSignature(key, u.Path, query))) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestSignURL(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/users/joe/default.jpg", "/users/joe/default.jpg?"},
+		{"/users/joe smith/100%.jpg", "/users/joe%20smith/100%25.jpg?"},
+		{"/users/joe?/#1.jpg", "/users/joe%3F/%231.jpg?"},
+	}
+
+	for _, test := range tests {
+		signedURL := SignURL("key", test.path, url.Values{"w": {"100"}})
+		expected := test.expected + "sig=" + URLSignature("key", test.path, url.Values{"w": {"100"}}) + "&w=100"
+		if signedURL != expected {
+			t.Errorf("%s: got %s, expected %s", test.path, signedURL, expected)
+		}
+
+		u, err := url.Parse("http://localhost" + signedURL)
+		if err != nil {
+			t.Fatalf("%s: %v", test.path, err)
+		}
+		if u.Path != test.path {
+			t.Errorf("%s: signed URL has path %s", test.path, u.Path)
+		}
+		if !ValidURLSignature([]string{"key"}, u) {
+			t.Errorf("%s: signed URL %s isn't valid", test.path, signedURL)
+		}
+	}
+}
+
+func TestURLSignature(t *testing.T) {
+	query := url.Values{"w": {"100"}, "h": {"50"}}
+	signature := URLSignature("key", "/joe.jpg", query)
+
+	reordered := url.Values{"h": {"50"}, "w": {"100"}, SignatureParam: {"ignored"}}
+	if s := URLSignature("key", "/joe.jpg", reordered); s != signature {
+		t.Errorf("got signature %s for reordered query, expected %s", s, signature)
+	}
+	if s := URLSignature("other", "/joe.jpg", query); s == signature {
+		t.Errorf("got the same signature for a different key")
+	}
+	if s := URLSignature("key", "/jane.jpg", query); s == signature {
+		t.Errorf("got the same signature for a different path")
+	}
+}
+
+func TestValidURLSignature(t *testing.T) {
+	signedURL := SignURL("key2", "/users/joe.jpg", url.Values{"w": {"100"}, "h": {"50"}})
+
+	tests := []struct {
+		description string
+		keys        []string
+		url         string
+		valid       bool
+	}{
+		{"signed", []string{"key2"}, signedURL, true},
+		{"any key", []string{"key1", "key2"}, signedURL, true},
+		{"wrong key", []string{"key1"}, signedURL, false},
+		{"no keys", nil, signedURL, false},
+		{"tampered query", []string{"key2"}, signedURL + "&q=10", false},
+		{"tampered path", []string{"key2"}, "/users/jane.jpg" + signedURL[len("/users/joe.jpg"):], false},
+		{"missing signature", []string{"key2"}, "/users/joe.jpg?h=50&w=100", false},
+		{"empty signature", []string{"key2"}, "/users/joe.jpg?h=50&sig=&w=100", false},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse("http://localhost" + test.url)
+		if err != nil {
+			t.Fatalf("%s: %v", test.description, err)
+		}
+		if valid := ValidURLSignature(test.keys, u); valid != test.valid {
+			t.Errorf("%s: got %t for %s, expected %t", test.description, valid, test.url, test.valid)
+		}
+	}
+}
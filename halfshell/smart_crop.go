@@ -0,0 +1,174 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+
+	"github.com/rafikk/imagick/imagick"
+)
+
+// smartCropAnalysisSize is the size of the longest side of the downscaled copy
+// of the image that smart crops are computed on.
+const smartCropAnalysisSize = 128
+
+// SmartFocalpoint computes the focal point of the crop of the given
+// dimensions that retains the most detail in the image. The image is
+// downscaled and the crop window is placed where the sum of the intensity
+// gradients, which are large along edges and in textured areas, is highest.
+// The focal point is expressed as the offset of the crop window, like
+// explicitly requested focal points.
+func SmartFocalpoint(wand *imagick.MagickWand, crop ImageDimensions) (Focalpoint, error) {
+	width, height := wand.GetImageWidth(), wand.GetImageHeight()
+	if width == 0 || height == 0 || crop.Width >= width && crop.Height >= height {
+		return DefaultFocalPoint, nil
+	}
+
+	scale := 1.0
+	if longest := float64(maxUint(width, height)); longest > smartCropAnalysisSize {
+		scale = smartCropAnalysisSize / longest
+	}
+	analysisWidth := maxUint(uint(float64(width)*scale+0.5), 1)
+	analysisHeight := maxUint(uint(float64(height)*scale+0.5), 1)
+
+	analysis := wand.Clone()
+	defer analysis.Destroy()
+	if analysisWidth != width || analysisHeight != height {
+		if err := analysis.ResizeImage(analysisWidth, analysisHeight, imagick.FILTER_BOX, 1); err != nil {
+			return DefaultFocalPoint, err
+		}
+	}
+
+	pixels, err := analysis.ExportImagePixels(0, 0, analysisWidth, analysisHeight, "I", imagick.PIXEL_CHAR)
+	if err != nil {
+		return DefaultFocalPoint, err
+	}
+	intensities, ok := pixels.([]byte)
+	if !ok || len(intensities) != int(analysisWidth*analysisHeight) {
+		return DefaultFocalPoint, fmt.Errorf("unexpected pixel data")
+	}
+
+	cropWidth := minUint(maxUint(uint(float64(crop.Width)*scale+0.5), 1), analysisWidth)
+	cropHeight := minUint(maxUint(uint(float64(crop.Height)*scale+0.5), 1), analysisHeight)
+
+	return focalpointForIntensities(intensities, int(analysisWidth), int(analysisHeight),
+		int(cropWidth), int(cropHeight)), nil
+}
+
+// focalpointForIntensities returns the focal point of the crop window with
+// the most detail in an image given as a buffer of 8-bit intensities, one per
+// pixel, row by row. The crop dimensions must not exceed the image's.
+func focalpointForIntensities(intensities []byte, width, height, cropWidth, cropHeight int) Focalpoint {
+	energy := gradientEnergy(intensities, width, height)
+	return focalpointForEnergy(energy, width, height, cropWidth, cropHeight)
+}
+
+// gradientEnergy returns the magnitude of the intensity gradient at each
+// pixel, approximated by the sum of the absolute horizontal and vertical
+// central differences.
+func gradientEnergy(intensities []byte, width, height int) []int {
+	energy := make([]int, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			left, right := maxInt(x-1, 0), minInt(x+1, width-1)
+			up, down := maxInt(y-1, 0), minInt(y+1, height-1)
+			dx := int(intensities[y*width+right]) - int(intensities[y*width+left])
+			dy := int(intensities[down*width+x]) - int(intensities[up*width+x])
+			energy[y*width+x] = absInt(dx) + absInt(dy)
+		}
+	}
+	return energy
+}
+
+// focalpointForEnergy slides a window of the crop dimensions over the energy
+// map and returns the focal point of the window with the most energy. Ties
+// are broken in favor of the window closest to the center.
+func focalpointForEnergy(energy []int, width, height, cropWidth, cropHeight int) Focalpoint {
+	// Summed-area table with an extra leading row and column of zeros, so the
+	// energy of any window can be computed in constant time.
+	sums := make([]int, (width+1)*(height+1))
+	for y := 0; y < height; y++ {
+		rowSum := 0
+		for x := 0; x < width; x++ {
+			rowSum += energy[y*width+x]
+			sums[(y+1)*(width+1)+x+1] = sums[y*(width+1)+x+1] + rowSum
+		}
+	}
+
+	maxX, maxY := width-cropWidth, height-cropHeight
+	bestX, bestY, bestEnergy, bestDistance := maxX/2, maxY/2, -1, 0
+	for y := 0; y <= maxY; y++ {
+		for x := 0; x <= maxX; x++ {
+			windowEnergy := sums[(y+cropHeight)*(width+1)+x+cropWidth] -
+				sums[y*(width+1)+x+cropWidth] -
+				sums[(y+cropHeight)*(width+1)+x] +
+				sums[y*(width+1)+x]
+			distance := absInt(2*x-maxX) + absInt(2*y-maxY)
+			if windowEnergy > bestEnergy || windowEnergy == bestEnergy && distance < bestDistance {
+				bestX, bestY, bestEnergy, bestDistance = x, y, windowEnergy, distance
+			}
+		}
+	}
+
+	focalpoint := DefaultFocalPoint
+	if maxX > 0 {
+		focalpoint.X = float64(bestX) / float64(maxX)
+	}
+	if maxY > 0 {
+		focalpoint.Y = float64(bestY) / float64(maxY)
+	}
+	return focalpoint
+}
+
+func minUint(a, b uint) uint {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxUint(a, b uint) uint {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func absInt(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
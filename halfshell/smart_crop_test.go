@@ -0,0 +1,102 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"reflect"
+	"testing"
+)
+
+// newTestIntensities returns the intensities of a black image of the given
+// dimensions with a checkerboard pattern in the given rectangle.
+func newTestIntensities(width, height, x0, y0, x1, y1 int) []byte {
+	intensities := make([]byte, width*height)
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			if (x+y)%2 == 0 {
+				intensities[y*width+x] = 255
+			}
+		}
+	}
+	return intensities
+}
+
+func TestGradientEnergy(t *testing.T) {
+	// 0   0   255
+	// 0   255 255
+	intensities := []byte{0, 0, 255, 0, 255, 255}
+	expected := []int{
+		0 + 0, 255 + 255, 255 + 0,
+		255 + 0, 255 + 255, 0 + 0,
+	}
+	if energy := gradientEnergy(intensities, 3, 2); !reflect.DeepEqual(energy, expected) {
+		t.Errorf("got energy %v, expected %v", energy, expected)
+	}
+}
+
+func TestFocalpointForEnergy(t *testing.T) {
+	// The window with the most energy is the 2x2 window at 1,1, since the
+	// summed-area table includes every pixel of each window.
+	energy := []int{
+		1, 0, 0, 0,
+		0, 5, 5, 0,
+		0, 5, 5, 0,
+		0, 0, 0, 9,
+	}
+	fp := focalpointForEnergy(energy, 4, 4, 2, 2)
+	if fp != (Focalpoint{0.5, 0.5}) {
+		t.Errorf("got focal point %v, expected 0.5,0.5", fp)
+	}
+
+	energy[15] = 30
+	fp = focalpointForEnergy(energy, 4, 4, 2, 2)
+	if fp != (Focalpoint{1, 1}) {
+		t.Errorf("got focal point %v, expected 1,1", fp)
+	}
+}
+
+func TestFocalpointForIntensities(t *testing.T) {
+	tests := []struct {
+		description           string
+		intensities           []byte
+		cropWidth, cropHeight int
+		expectedX             float64
+		minY, maxY            float64
+	}{
+		{"detail at top", newTestIntensities(10, 40, 0, 2, 10, 8), 10, 10, 0.5, 0, 0.1},
+		{"detail at bottom", newTestIntensities(10, 40, 0, 32, 10, 38), 10, 10, 0.5, 0.9, 1},
+		{"flat", make([]byte, 10*40), 10, 10, 0.5, 0.5, 0.5},
+	}
+
+	for _, test := range tests {
+		fp := focalpointForIntensities(test.intensities, 10, 40, test.cropWidth, test.cropHeight)
+		if fp.X != test.expectedX || fp.Y < test.minY || fp.Y > test.maxY {
+			t.Errorf("%s: got focal point %v", test.description, fp)
+		}
+	}
+
+	// Detail in the left corner of a wide image.
+	intensities := newTestIntensities(40, 10, 1, 1, 7, 9)
+	fp := focalpointForIntensities(intensities, 40, 10, 10, 10)
+	if fp.X > 0.1 || fp.Y != 0.5 {
+		t.Errorf("got focal point %v, expected left", fp)
+	}
+}
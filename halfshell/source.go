@@ -21,8 +21,16 @@
 package halfshell
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 type ImageSourceType string
@@ -38,8 +46,36 @@ type ImageSource interface {
 
 type ImageSourceOptions struct {
 	Path string
+	// Limits bounds the dimensions of the images decoded by the source.
+	Limits *ImageLimits
 }
 
+// ImageMetadata describes the original image retrieved from a source.
+type ImageMetadata struct {
+	// ETag identifies the version of the original image. It is empty if the
+	// source is unable to identify versions.
+	ETag         string
+	LastModified time.Time
+	// Source is the name of the member source that the image was retrieved
+	// from when it was retrieved through a chain source.
+	Source string
+	// Focalpoint is the focal point stored with the original image. It is nil
+	// if the source has no focal point for the image.
+	Focalpoint *Focalpoint
+}
+
+// ImageMetadataSource is implemented by image sources that are able to
+// retrieve the metadata of an image cheaply, without retrieving the image
+// itself. Sources that would need a round trip to a remote server don't
+// implement it, since the image is retrieved anyway when it has changed.
+type ImageMetadataSource interface {
+	GetImageMetadata(*ImageSourceOptions) (*ImageMetadata, error)
+}
+
+// errMetadataUnsupported is returned by sources wrapping other sources when
+// asked for metadata that the wrapped source doesn't provide.
+var errMetadataUnsupported = errors.New("image source doesn't provide metadata")
+
 func RegisterSource(sourceType ImageSourceType, factory ImageSourceFactoryFunction) {
 	imageSourceTypeToFactoryFunctionMap[sourceType] = factory
 }
@@ -52,3 +88,122 @@ func NewImageSourceWithConfig(config *SourceConfig) ImageSource {
 	}
 	return factory(config)
 }
+
+// NewImageMetadataFromHeader creates image metadata from the ETag and
+// Last-Modified headers of an HTTP response.
+func NewImageMetadataFromHeader(header http.Header) ImageMetadata {
+	lastModified, _ := http.ParseTime(header.Get("Last-Modified"))
+	return ImageMetadata{
+		ETag:         header.Get("ETag"),
+		LastModified: lastModified,
+	}
+}
+
+// NewFocalpointFromMetadata parses a focal point stored with an original image.
+// A nil focal point is returned if the value is empty.
+func NewFocalpointFromMetadata(value string) (*Focalpoint, error) {
+	if value == "" {
+		return nil, nil
+	}
+	fp, err := ParseFocalpoint(value)
+	if err != nil {
+		return nil, err
+	}
+	if !fp.Valid() {
+		return nil, fmt.Errorf("focal point %q is not between 0,0 and 1,1", value)
+	}
+	return &fp, nil
+}
+
+// focalpointForHeader returns the focal point in the named header of an HTTP
+// response. Invalid focal points are logged and ignored.
+func focalpointForHeader(header http.Header, name string, logger *Logger) *Focalpoint {
+	fp, err := NewFocalpointFromMetadata(header.Get(name))
+	if err != nil {
+		logger.Warnf("Ignoring %s header: %s", name, err)
+	}
+	return fp
+}
+
+// genericContentTypes are declared content types that don't identify the type
+// of the data, e.g. the default content type of S3 objects. Only the sniffed
+// content type is checked for them.
+var genericContentTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+}
+
+// ReadSourceImage reads the image data retrieved by a source, enforcing the
+// source's max_source_bytes and allowed_content_types settings before the
+// data is decoded. The declared size and content type, e.g. from the
+// Content-Length and Content-Type headers, are checked first if known; a size
+// of -1 means unknown. The size limit is also enforced while reading.
+func ReadSourceImage(config *SourceConfig, reader io.Reader, size int64, contentType string) ([]byte, error) {
+	maxBytes := int64(config.MaxSourceBytes)
+	if maxBytes > 0 && size > maxBytes {
+		return nil, NewImageError(ErrorKindSourceTooLarge,
+			fmt.Errorf("image size %d exceeds %d bytes", size, maxBytes), "Image is too large")
+	}
+
+	if len(config.AllowedContentTypes) > 0 {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		if !genericContentTypes[mediaType] && !contentTypeAllowed(config.AllowedContentTypes, mediaType) {
+			return nil, NewImageError(ErrorKindUnsupportedMediaType,
+				fmt.Errorf("content type %s not allowed", contentType), "Unsupported image type")
+		}
+	}
+
+	if maxBytes > 0 {
+		reader = io.LimitReader(reader, maxBytes+1)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, imageErrorForRequestError(err)
+	}
+	if maxBytes > 0 && int64(len(data)) > maxBytes {
+		return nil, NewImageError(ErrorKindSourceTooLarge,
+			fmt.Errorf("image size exceeds %d bytes", maxBytes), "Image is too large")
+	}
+
+	if len(config.AllowedContentTypes) > 0 && len(data) > 0 {
+		sniffedType := SniffImageContentType(data)
+		if !contentTypeAllowed(config.AllowedContentTypes, sniffedType) {
+			return nil, NewImageError(ErrorKindUnsupportedMediaType,
+				fmt.Errorf("detected content type %s not allowed", sniffedType), "Unsupported image type")
+		}
+	}
+
+	return data, nil
+}
+
+// SniffImageContentType returns the content type of image data as determined
+// by its magic bytes.
+func SniffImageContentType(data []byte) string {
+	switch {
+	case len(data) >= 12 && bytes.Equal(data[4:8], []byte("ftyp")) &&
+		(bytes.Equal(data[8:12], []byte("avif")) || bytes.Equal(data[8:12], []byte("avis"))):
+		return "image/avif"
+	case len(data) >= 12 && bytes.Equal(data[4:8], []byte("ftyp")) &&
+		(bytes.Equal(data[8:12], []byte("heic")) || bytes.Equal(data[8:12], []byte("heix")) ||
+			bytes.Equal(data[8:12], []byte("mif1"))):
+		return "image/heic"
+	case bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*")):
+		return "image/tiff"
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	return mediaType
+}
+
+// contentTypeAllowed returns a bool indicating whether the content type
+// matches one of the allowed content types. An allowed content type ending
+// with "/*" matches all subtypes.
+func contentTypeAllowed(allowedContentTypes []string, contentType string) bool {
+	for _, allowed := range allowedContentTypes {
+		if allowed == contentType ||
+			(strings.HasSuffix(allowed, "/*") && strings.HasPrefix(contentType, allowed[:len(allowed)-1])) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+const (
+	ImageSourceTypeChain ImageSourceType = "chain"
+)
+
+// DefaultChainFallthrough lists the kinds of errors that cause a chain source
+// to try its next member source when none are configured.
+var DefaultChainFallthrough = []ImageErrorKind{ErrorKindNotFound}
+
+// ChainImageSource is a composite image source that tries each of its member
+// sources in order until one returns the image. Only errors of the kinds
+// listed in the source's fallthrough setting cause the next member to be
+// tried; other errors are returned immediately.
+type ChainImageSource struct {
+	Config  *SourceConfig
+	Logger  *Logger
+	Sources []ImageSource
+}
+
+func NewChainImageSourceWithConfig(config *SourceConfig) ImageSource {
+	source := &ChainImageSource{
+		Config: config,
+		Logger: NewLogger("source.chain.%s", config.Name),
+	}
+	for _, memberConfig := range config.ChainSourceConfigs {
+		source.Sources = append(source.Sources, NewImageSourceWithCircuitBreaker(memberConfig))
+	}
+	return source
+}
+
+// GetImage returns the image from the first member source that has it. The
+// name of the member source is recorded in the image's metadata.
+func (s *ChainImageSource) GetImage(request *ImageSourceOptions) (*Image, error) {
+	var err error
+	for i, source := range s.Sources {
+		var image *Image
+		image, err = source.GetImage(request)
+		if err == nil {
+			if image.Metadata.Source == "" {
+				image.Metadata.Source = s.Config.ChainSourceConfigs[i].Name
+			}
+			return image, nil
+		}
+		if !s.shouldFallthrough(err) {
+			return nil, err
+		}
+		s.Logger.Infof("Image %s not available from source %s: %v",
+			request.Path, s.Config.ChainSourceConfigs[i].Name, err)
+	}
+	return nil, err
+}
+
+// GetImageMetadata returns the metadata of the image from the first member
+// source that has it. An error is returned if a member source that would have
+// to be consulted can't retrieve metadata.
+func (s *ChainImageSource) GetImageMetadata(request *ImageSourceOptions) (*ImageMetadata, error) {
+	var err error
+	for i, source := range s.Sources {
+		metadataSource, ok := source.(ImageMetadataSource)
+		if !ok {
+			return nil, NewImageError(ErrorKindInternal,
+				errMetadataUnsupported, "Internal Server Error")
+		}
+		var metadata *ImageMetadata
+		metadata, err = metadataSource.GetImageMetadata(request)
+		if err == nil {
+			if metadata.Source == "" {
+				metadata.Source = s.Config.ChainSourceConfigs[i].Name
+			}
+			return metadata, nil
+		}
+		if !s.shouldFallthrough(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+func (s *ChainImageSource) shouldFallthrough(err error) bool {
+	for _, kind := range s.Config.ChainFallthrough {
+		if IsImageErrorKind(err, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	RegisterSource(ImageSourceTypeChain, NewChainImageSourceWithConfig)
+}
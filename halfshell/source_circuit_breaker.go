@@ -0,0 +1,243 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCircuitBreakerErrorRate   = 0.5
+	DefaultCircuitBreakerMinRequests = 20
+	DefaultCircuitBreakerWindow      = 10.0
+	DefaultCircuitBreakerCooldown    = 30.0
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+var circuitStateNames = map[circuitState]string{
+	circuitClosed:   "closed",
+	circuitOpen:     "open",
+	circuitHalfOpen: "half_open",
+}
+
+// CircuitBreakerImageSource wraps an ImageSource so that requests fail fast
+// while the source is failing. The circuit opens when the rate of upstream
+// errors and timeouts within a window exceeds the configured error rate.
+// While open, requests fail immediately with ErrorKindCircuitOpen. After the
+// cooldown, the circuit half-opens and lets a single request through to probe
+// the source: if it succeeds the circuit closes, otherwise it opens again.
+type CircuitBreakerImageSource struct {
+	Source      ImageSource
+	Name        string
+	ErrorRate   float64
+	MinRequests uint64
+	Window      time.Duration
+	Cooldown    time.Duration
+	Logger      *Logger
+	Statter     Statter
+
+	mutex       sync.Mutex
+	state       circuitState
+	windowStart time.Time
+	requests    uint64
+	failures    uint64
+	openedAt    time.Time
+	probing     bool
+}
+
+var (
+	circuitBreakersBySource      = make(map[*SourceConfig]*CircuitBreakerImageSource)
+	circuitBreakersBySourceMutex sync.Mutex
+)
+
+// NewImageSourceWithCircuitBreaker returns a new instance of the source, or
+// the source's circuit breaker if it has one configured.
+func NewImageSourceWithCircuitBreaker(config *SourceConfig) ImageSource {
+	if config.CircuitBreakerConfig == nil {
+		return NewImageSourceWithConfig(config)
+	}
+	return CircuitBreakerForConfig(config)
+}
+
+// CircuitBreakerForConfig returns the circuit breaker of the source, creating
+// it if needed. Routes and chain sources using the same source share its
+// circuit breaker, so that its failures are counted together. The breaker
+// reports to StatsD under sources.<name>.
+func CircuitBreakerForConfig(config *SourceConfig) *CircuitBreakerImageSource {
+	circuitBreakersBySourceMutex.Lock()
+	breaker, ok := circuitBreakersBySource[config]
+	circuitBreakersBySourceMutex.Unlock()
+	if ok {
+		return breaker
+	}
+
+	// The source is created without holding the lock, since chain sources
+	// create the circuit breakers of their members.
+	statter := newStatsdStatter(fmt.Sprintf("sources.%s", config.Name), config.CircuitBreakerConfig.StatterConfig)
+	breaker = NewCircuitBreakerImageSource(NewImageSourceWithConfig(config), config, statter)
+
+	circuitBreakersBySourceMutex.Lock()
+	defer circuitBreakersBySourceMutex.Unlock()
+	if existing, ok := circuitBreakersBySource[config]; ok {
+		return existing
+	}
+	circuitBreakersBySource[config] = breaker
+	return breaker
+}
+
+// NewCircuitBreakerImageSource returns a CircuitBreakerImageSource wrapping
+// source. State changes are logged and reported to StatsD as
+// circuit_breaker.<state>.
+func NewCircuitBreakerImageSource(source ImageSource, config *SourceConfig, statter Statter) *CircuitBreakerImageSource {
+	breakerConfig := config.CircuitBreakerConfig
+	breaker := &CircuitBreakerImageSource{
+		Source:      source,
+		Name:        config.Name,
+		ErrorRate:   breakerConfig.ErrorRate,
+		MinRequests: breakerConfig.MinRequests,
+		Window:      secondsDuration(breakerConfig.Window),
+		Cooldown:    secondsDuration(breakerConfig.Cooldown),
+		Logger:      NewLogger("circuit_breaker.%s", config.Name),
+		Statter:     statter,
+	}
+	if breaker.ErrorRate == 0 {
+		breaker.ErrorRate = DefaultCircuitBreakerErrorRate
+	}
+	if breaker.MinRequests == 0 {
+		breaker.MinRequests = DefaultCircuitBreakerMinRequests
+	}
+	return breaker
+}
+
+func (s *CircuitBreakerImageSource) GetImage(request *ImageSourceOptions) (*Image, error) {
+	probe, err := s.allow()
+	if err != nil {
+		return nil, err
+	}
+	image, err := s.Source.GetImage(request)
+	s.record(err, probe)
+	return image, err
+}
+
+func (s *CircuitBreakerImageSource) GetImageMetadata(request *ImageSourceOptions) (*ImageMetadata, error) {
+	metadataSource, ok := s.Source.(ImageMetadataSource)
+	if !ok {
+		return nil, errMetadataUnsupported
+	}
+	probe, err := s.allow()
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := metadataSource.GetImageMetadata(request)
+	s.record(err, probe)
+	return metadata, err
+}
+
+// allow returns an error if the request must not be sent to the source, and
+// otherwise whether the request is the probe of a half-open circuit.
+func (s *CircuitBreakerImageSource) allow() (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch s.state {
+	case circuitOpen:
+		if time.Since(s.openedAt) < s.Cooldown {
+			return false, s.circuitOpenError()
+		}
+		s.setState(circuitHalfOpen)
+		s.probing = true
+		return true, nil
+	case circuitHalfOpen:
+		if s.probing {
+			return false, s.circuitOpenError()
+		}
+		s.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// record updates the state of the circuit with the result of a request.
+func (s *CircuitBreakerImageSource) record(err error, probe bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	failed := IsImageErrorKind(err, ErrorKindUpstreamUnavailable) || IsImageErrorKind(err, ErrorKindTimeout)
+
+	if probe {
+		s.probing = false
+		if failed {
+			s.openedAt = time.Now()
+			s.setState(circuitOpen)
+		} else {
+			s.resetWindow()
+			s.setState(circuitClosed)
+		}
+		return
+	}
+
+	if s.state != circuitClosed {
+		return
+	}
+
+	if time.Since(s.windowStart) >= s.Window {
+		s.resetWindow()
+	}
+	s.requests++
+	if failed {
+		s.failures++
+	}
+
+	if s.requests >= s.MinRequests && float64(s.failures)/float64(s.requests) >= s.ErrorRate {
+		s.Logger.Warnf("%d of %d requests failed", s.failures, s.requests)
+		s.openedAt = time.Now()
+		s.setState(circuitOpen)
+	}
+}
+
+func (s *CircuitBreakerImageSource) resetWindow() {
+	s.windowStart = time.Now()
+	s.requests = 0
+	s.failures = 0
+}
+
+func (s *CircuitBreakerImageSource) setState(state circuitState) {
+	s.state = state
+	s.Logger.Infof("Circuit %s", circuitStateNames[state])
+	if s.Statter != nil {
+		s.Statter.Increment(fmt.Sprintf("circuit_breaker.%s", circuitStateNames[state]))
+	}
+}
+
+func (s *CircuitBreakerImageSource) circuitOpenError() error {
+	return NewImageError(ErrorKindCircuitOpen,
+		errors.New("circuit breaker open for source "+s.Name), "Image source unavailable")
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"sync"
+)
+
+// CoalescingImageSource wraps an ImageSource so that concurrent requests for
+// the same image share a single retrieval from the underlying source, e.g.
+// when different sizes of a newly published image are requested at once.
+type CoalescingImageSource struct {
+	Source ImageSource
+	Name   string
+	flight flightGroup
+}
+
+var (
+	coalescingSourcesBySource      = make(map[*SourceConfig]*CoalescingImageSource)
+	coalescingSourcesBySourceMutex sync.Mutex
+)
+
+// CoalescingImageSourceForConfig returns the coalescing source wrapping the
+// source, creating it if needed. Routes using the same source share it, so
+// that concurrent requests for an image through different routes also share
+// a single retrieval.
+func CoalescingImageSourceForConfig(config *SourceConfig) *CoalescingImageSource {
+	coalescingSourcesBySourceMutex.Lock()
+	defer coalescingSourcesBySourceMutex.Unlock()
+	if source, ok := coalescingSourcesBySource[config]; ok {
+		return source
+	}
+	source := NewCoalescingImageSource(NewImageSourceWithCircuitBreaker(config), config.Name)
+	coalescingSourcesBySource[config] = source
+	return source
+}
+
+// NewCoalescingImageSource returns a CoalescingImageSource wrapping source.
+func NewCoalescingImageSource(source ImageSource, name string) *CoalescingImageSource {
+	return &CoalescingImageSource{Source: source, Name: name}
+}
+
+func (s *CoalescingImageSource) GetImage(request *ImageSourceOptions) (*Image, error) {
+	value, callers, err := s.flight.Do(s.flightKey(request), func() (interface{}, error) {
+		image, err := s.Source.GetImage(request)
+		if err != nil {
+			return nil, err
+		}
+		return &sharedImage{image: image}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*sharedImage).take(callers), nil
+}
+
+// flightKey returns the key of requests for the same image. Requests with
+// different limits aren't coalesced, since the limits are checked when the
+// image is retrieved.
+func (s *CoalescingImageSource) flightKey(request *ImageSourceOptions) string {
+	key := fmt.Sprintf("%s:%s", s.Name, request.Path)
+	if request.Limits != nil {
+		key += fmt.Sprintf(":%d,%d,%d", request.Limits.MaxPixels, request.Limits.MaxWidth, request.Limits.MaxHeight)
+	}
+	return key
+}
+
+func (s *CoalescingImageSource) GetImageMetadata(request *ImageSourceOptions) (*ImageMetadata, error) {
+	metadataSource, ok := s.Source.(ImageMetadataSource)
+	if !ok {
+		return nil, errMetadataUnsupported
+	}
+	return metadataSource.GetImageMetadata(request)
+}
+
+// sharedImage hands out copies of an image to the callers sharing it, since
+// each of them processes and destroys the image it receives.
+type sharedImage struct {
+	mutex sync.Mutex
+	image *Image
+	taken int
+}
+
+// take returns a copy of the image for one of the callers sharing it. The
+// last caller receives the image itself.
+func (s *sharedImage) take(callers int) *Image {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.taken++
+	if s.taken == callers {
+		return s.image
+	}
+	return s.image.Clone()
+}
@@ -21,6 +21,9 @@
 package halfshell
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -28,11 +31,26 @@ import (
 
 const (
 	ImageSourceTypeFilesystem ImageSourceType = "filesystem"
+
+	// FileSystemLayoutFlat maps request paths onto files directly in the
+	// source directory, replacing directory separators with underscores, e.g.
+	// /a/b/c.jpg is read from a_b_c.jpg.
+	FileSystemLayoutFlat = "flat"
+	// FileSystemLayoutTree maps request paths onto files in subdirectories of
+	// the source directory, e.g. /a/b/c.jpg is read from a/b/c.jpg.
+	FileSystemLayoutTree = "tree"
+
+	// FocalpointSidecarExtension is appended to the names of image files to
+	// get the names of their sidecar files, e.g. c.jpg.json for c.jpg.
+	FocalpointSidecarExtension = ".json"
 )
 
 type FileSystemImageSource struct {
 	Config *SourceConfig
 	Logger *Logger
+	// directory is the source directory with symlinks resolved, which all
+	// files must be within.
+	directory string
 }
 
 func NewFileSystemImageSourceWithConfig(config *SourceConfig) ImageSource {
@@ -52,36 +70,164 @@ func NewFileSystemImageSourceWithConfig(config *SourceConfig) ImageSource {
 		source.Logger.Fatal(err)
 	}
 
+	defer baseDirectory.Close()
+
 	fileInfo, err := baseDirectory.Stat()
 	if err != nil || !fileInfo.IsDir() {
 		source.Logger.Fatal("Directory ", source.Config.Directory, " not a directory", err)
 	}
 
+	source.directory, err = filepath.EvalSymlinks(source.Config.Directory)
+	if err == nil {
+		source.directory, err = filepath.Abs(source.directory)
+	}
+	if err != nil {
+		source.Logger.Fatal(err)
+	}
+
 	return source
 }
 
 func (s *FileSystemImageSource) GetImage(request *ImageSourceOptions) (*Image, error) {
-	fileName := s.fileNameForRequest(request)
+	fileName, err := s.fileNameForRequest(request)
+	if err != nil {
+		s.Logger.Warnf("Invalid image path %s: %v", request.Path, err)
+		return nil, err
+	}
 
 	file, err := os.Open(fileName)
 	if err != nil {
 		s.Logger.Warnf("Failed to open file: %v", err)
+		return nil, imageErrorForFileError(err)
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		s.Logger.Warnf("Failed to stat file: %v", err)
+		return nil, imageErrorForFileError(err)
+	}
+
+	data, err := ReadSourceImage(s.Config, file, fileInfo.Size(), "")
+	if err != nil {
+		s.Logger.Warnf("Failed to read image: %v", err)
 		return nil, err
 	}
 
-	image, err := NewImageFromFile(file)
+	image, err := NewImageFromBytes(data, request.Limits)
 	if err != nil {
 		s.Logger.Warnf("Failed to read image: %v", err)
 		return nil, err
 	}
+	image.Metadata = imageMetadataForFileInfo(fileInfo)
+	image.Metadata.Focalpoint = s.focalpointForFile(fileName)
 
 	return image, nil
 }
 
-func (s *FileSystemImageSource) fileNameForRequest(request *ImageSourceOptions) string {
-	// Remove the leading / from the file name and replace the
-	// directory separator (/) with something safe for file names (_)
-	return filepath.Join(s.Config.Directory, strings.Replace(strings.TrimLeft(request.Path, string(filepath.Separator)), string(filepath.Separator), "_", -1))
+func (s *FileSystemImageSource) GetImageMetadata(request *ImageSourceOptions) (*ImageMetadata, error) {
+	fileName, err := s.fileNameForRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := os.Stat(fileName)
+	if err != nil {
+		return nil, imageErrorForFileError(err)
+	}
+	metadata := imageMetadataForFileInfo(fileInfo)
+	metadata.Focalpoint = s.focalpointForFile(fileName)
+	return &metadata, nil
+}
+
+// focalpointForFile returns the focal point stored in the sidecar file of the
+// given image file, e.g. {"focalpoint": "0.3,0.6"}. Nil is returned if focal
+// point metadata is disabled or the image has no valid sidecar file.
+func (s *FileSystemImageSource) focalpointForFile(fileName string) *Focalpoint {
+	if !s.Config.FocalpointMetadata {
+		return nil
+	}
+
+	sidecarName, err := filepath.EvalSymlinks(fileName + FocalpointSidecarExtension)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		s.Logger.Warnf("Failed to resolve sidecar file: %v", err)
+		return nil
+	}
+	if !strings.HasPrefix(sidecarName, s.directory+string(filepath.Separator)) {
+		s.Logger.Warnf("Ignoring sidecar file %s outside of %s", sidecarName, s.directory)
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(sidecarName)
+	if err != nil {
+		s.Logger.Warnf("Failed to read sidecar file: %v", err)
+		return nil
+	}
+	var sidecar struct {
+		Focalpoint string `json:"focalpoint"`
+	}
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		s.Logger.Warnf("Invalid sidecar file %s: %v", sidecarName, err)
+		return nil
+	}
+	fp, err := NewFocalpointFromMetadata(sidecar.Focalpoint)
+	if err != nil {
+		s.Logger.Warnf("Invalid sidecar file %s: %v", sidecarName, err)
+	}
+	return fp
+}
+
+// fileNameForRequest returns the name of the file for the request, with
+// symlinks resolved. Paths containing ".." components are rejected as bad
+// options. Hidden files, whose names begin with ".", and files outside the
+// source directory, e.g. through symlinks, are reported as not found.
+func (s *FileSystemImageSource) fileNameForRequest(request *ImageSourceOptions) (string, error) {
+	var components []string
+	for _, component := range strings.Split(request.Path, "/") {
+		switch {
+		case component == "" || component == ".":
+			continue
+		case component == ".." || strings.ContainsAny(component, "\\\x00"):
+			return "", NewImageError(ErrorKindBadOptions,
+				fmt.Errorf("invalid path %q", request.Path), "Invalid image path")
+		case strings.HasPrefix(component, "."):
+			return "", NewImageError(ErrorKindNotFound,
+				fmt.Errorf("hidden file in path %q", request.Path), "Image not found")
+		}
+		components = append(components, component)
+	}
+	if len(components) == 0 {
+		return "", NewImageError(ErrorKindNotFound,
+			fmt.Errorf("empty path %q", request.Path), "Image not found")
+	}
+
+	var fileName string
+	if s.Config.Layout == FileSystemLayoutTree {
+		fileName = filepath.Join(append([]string{s.directory}, components...)...)
+	} else {
+		// Replace the directory separator (/) with something safe for file
+		// names (_)
+		fileName = filepath.Join(s.directory, strings.Join(components, "_"))
+	}
+
+	resolvedFileName, err := filepath.EvalSymlinks(fileName)
+	if err != nil {
+		return "", imageErrorForFileError(err)
+	}
+	if !strings.HasPrefix(resolvedFileName, s.directory+string(filepath.Separator)) {
+		return "", NewImageError(ErrorKindNotFound,
+			fmt.Errorf("%s is outside of %s", resolvedFileName, s.directory), "Image not found")
+	}
+
+	return resolvedFileName, nil
+}
+
+func imageMetadataForFileInfo(fileInfo os.FileInfo) ImageMetadata {
+	return ImageMetadata{
+		ETag:         fmt.Sprintf("\"%x-%x\"", fileInfo.ModTime().UnixNano(), fileInfo.Size()),
+		LastModified: fileInfo.ModTime(),
+	}
 }
 
 func init() {
@@ -0,0 +1,138 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestFileSystemImageSources creates flat and tree layout sources for a
+// temporary directory containing:
+//
+//	images/a_b_c.jpg
+//	images/a/b/c.jpg
+//	images/.hidden.jpg
+//	images/a/.hidden.jpg
+//	images/escape.jpg -> ../secret.jpg
+//	images/a/escape -> ..
+//	secret.jpg
+func newTestFileSystemImageSources(t *testing.T) (flat, tree *FileSystemImageSource) {
+	root, err := ioutil.TempDir("", "halfshell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	directory := filepath.Join(root, "images")
+	if err := os.MkdirAll(filepath.Join(directory, "a", "b"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		filepath.Join(directory, "a_b_c.jpg"),
+		filepath.Join(directory, "a", "b", "c.jpg"),
+		filepath.Join(directory, ".hidden.jpg"),
+		filepath.Join(directory, "a", ".hidden.jpg"),
+		filepath.Join(root, "secret.jpg"),
+	} {
+		if err := ioutil.WriteFile(name, []byte("image"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(root, "secret.jpg"), filepath.Join(directory, "escape.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(root, filepath.Join(directory, "a", "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	newSource := func(layout string) *FileSystemImageSource {
+		config := &SourceConfig{Name: layout, Directory: directory, Layout: layout}
+		return NewFileSystemImageSourceWithConfig(config).(*FileSystemImageSource)
+	}
+	return newSource(FileSystemLayoutFlat), newSource(FileSystemLayoutTree)
+}
+
+func TestFileSystemImageSourceFileNameForRequest(t *testing.T) {
+	flat, tree := newTestFileSystemImageSources(t)
+
+	tests := []struct {
+		source *FileSystemImageSource
+		path   string
+		name   string
+	}{
+		{flat, "/a/b/c.jpg", "a_b_c.jpg"},
+		{flat, "a_b_c.jpg", "a_b_c.jpg"},
+		{tree, "/a/b/c.jpg", filepath.Join("a", "b", "c.jpg")},
+		{tree, "/a//b/./c.jpg", filepath.Join("a", "b", "c.jpg")},
+	}
+
+	for _, test := range tests {
+		name, err := test.source.fileNameForRequest(&ImageSourceOptions{Path: test.path})
+		if err != nil {
+			t.Errorf("%s %s: unexpected error: %v", test.source.Config.Layout, test.path, err)
+			continue
+		}
+		if expected := filepath.Join(test.source.directory, test.name); name != expected {
+			t.Errorf("%s %s: got %s, expected %s", test.source.Config.Layout, test.path, name, expected)
+		}
+	}
+}
+
+func TestFileSystemImageSourceRejectsTraversal(t *testing.T) {
+	flat, tree := newTestFileSystemImageSources(t)
+
+	tests := []struct {
+		path       string
+		kind       ImageErrorKind
+		statusCode int
+	}{
+		{"/../secret.jpg", ErrorKindBadOptions, 400},
+		{"/a/../../secret.jpg", ErrorKindBadOptions, 400},
+		{"/a/b/../../../secret.jpg", ErrorKindBadOptions, 400},
+		{"/..", ErrorKindBadOptions, 400},
+		{"/a\\..\\secret.jpg", ErrorKindBadOptions, 400},
+		{"/a/b/c.jpg\x00", ErrorKindBadOptions, 400},
+		{"/.hidden.jpg", ErrorKindNotFound, 404},
+		{"/a/.hidden.jpg", ErrorKindNotFound, 404},
+		{"/escape.jpg", ErrorKindNotFound, 404},
+		{"/a/escape/secret.jpg", ErrorKindNotFound, 404},
+		{"/", ErrorKindNotFound, 404},
+		{"/missing.jpg", ErrorKindNotFound, 404},
+	}
+
+	for _, source := range []*FileSystemImageSource{flat, tree} {
+		for _, test := range tests {
+			_, err := source.fileNameForRequest(&ImageSourceOptions{Path: test.path})
+			if err == nil {
+				t.Errorf("%s %q: expected error", source.Config.Layout, test.path)
+				continue
+			}
+			imageError := ImageErrorFromError(err)
+			if imageError.Kind != test.kind || imageError.StatusCode() != test.statusCode {
+				t.Errorf("%s %q: got %s (%d), expected %s (%d)", source.Config.Layout, test.path,
+					imageError.Kind, imageError.StatusCode(), test.kind, test.statusCode)
+			}
+		}
+	}
+}
@@ -22,50 +22,96 @@ package halfshell
 
 import (
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 )
 
 const (
 	ImageSourceTypeHttp ImageSourceType = "http"
+
+	// DefaultFocalpointHeader is the response header that HTTP sources read
+	// focal points from when focalpoint_metadata is enabled.
+	DefaultFocalpointHeader = "X-Focalpoint"
 )
 
 type HttpImageSource struct {
-	Config *SourceConfig
-	Logger *Logger
+	Config          *SourceConfig
+	Logger          *Logger
+	Client          *HTTPClient
+	RemoteURLPolicy *RemoteURLPolicy
 }
 
 func NewHttpImageSourceWithConfig(config *SourceConfig) ImageSource {
-	return &HttpImageSource{
+	source := &HttpImageSource{
 		Config: config,
 		Logger: NewLogger("source.http.%s", config.Name),
+		Client: HTTPClientForConfig(config),
+	}
+	if config.RemoteURLs {
+		if len(config.AllowedHosts) == 0 {
+			fmt.Fprintf(os.Stderr, "No allowed hosts specified for remote URLs of source %s\n", config.Name)
+			os.Exit(1)
+		}
+		source.RemoteURLPolicy = NewRemoteURLPolicyWithConfig(config)
 	}
+	return source
 }
 
 func (s *HttpImageSource) GetImage(request *ImageSourceOptions) (*Image, error) {
-	httpRequest := s.getHttpRequest(request)
-	httpResponse, err := http.DefaultClient.Do(httpRequest)
-	defer httpResponse.Body.Close()
+	httpRequest, err := s.getHttpRequest(request)
 	if err != nil {
-		s.Logger.Warnf("Error downlading image: %v", err)
+		s.Logger.Warnf("Invalid image URL %s: %v", request.Path, err)
 		return nil, err
 	}
+	httpResponse, err := s.Client.Do(httpRequest)
+	if err != nil {
+		s.Logger.Warnf("Error downlading image: %v", err)
+		return nil, imageErrorForRequestError(err)
+	}
+	defer httpResponse.Body.Close()
 	if httpResponse.StatusCode != 200 {
-		return nil, fmt.Errorf("Error downlading image (url=%v)", httpRequest.URL)
+		s.Logger.Warnf("Error downlading image (url=%v, status=%d)", httpRequest.URL, httpResponse.StatusCode)
+		return nil, imageErrorForStatusCode(httpResponse.StatusCode)
 	}
-	image, err := NewImageFromBuffer(httpResponse.Body)
+	data, err := ReadSourceImage(s.Config, httpResponse.Body,
+		httpResponse.ContentLength, httpResponse.Header.Get("Content-Type"))
 	if err != nil {
-		responseBody, _ := ioutil.ReadAll(httpResponse.Body)
-		s.Logger.Warnf("Unable to create image from response body: %v (url=%v)", string(responseBody), httpRequest.URL)
+		s.Logger.Warnf("Unable to read response body: %v (url=%v)", err, httpRequest.URL)
 		return nil, err
 	}
+	image, err := NewImageFromBytes(data, request.Limits)
+	if err != nil {
+		s.Logger.Warnf("Unable to create image from response body: %v (url=%v)", err, httpRequest.URL)
+		return nil, err
+	}
+	image.Metadata = s.imageMetadataForResponse(httpResponse)
 	s.Logger.Infof("Successfully retrieved image from http: %v", httpRequest.URL)
 	return image, nil
 }
 
-func (s *HttpImageSource) getHttpRequest(request *ImageSourceOptions) *http.Request {
+func (s *HttpImageSource) imageMetadataForResponse(httpResponse *http.Response) ImageMetadata {
+	metadata := NewImageMetadataFromHeader(httpResponse.Header)
+	if s.Config.FocalpointMetadata {
+		metadata.Focalpoint = focalpointForHeader(httpResponse.Header, s.Config.FocalpointHeader, s.Logger)
+	}
+	return metadata
+}
+
+// getHttpRequest returns the request for the image. If the source retrieves
+// remote URLs, the image path is the URL of the image, which must be allowed by
+// the source's policy. Otherwise the image path is relative to the source's
+// host and directory.
+func (s *HttpImageSource) getHttpRequest(request *ImageSourceOptions) (*http.Request, error) {
+	if s.RemoteURLPolicy != nil {
+		remoteURL, err := s.RemoteURLPolicy.ParseURL(request.Path)
+		if err != nil {
+			return nil, err
+		}
+		return http.NewRequest("GET", remoteURL.String(), nil)
+	}
+
 	path := s.Config.Directory + request.Path
 	imageURLPathComponents := strings.Split(path, "/")
 
@@ -82,7 +128,7 @@ func (s *HttpImageSource) getHttpRequest(request *ImageSourceOptions) *http.Requ
 	httpRequest, _ := http.NewRequest("GET", requestURL.RequestURI(), nil)
 	httpRequest.URL = requestURL
 
-	return httpRequest
+	return httpRequest, nil
 }
 
 func init() {
@@ -22,75 +22,127 @@ package halfshell
 
 import (
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"time"
-
-	"github.com/oysterbooks/s3"
 )
 
 const (
 	ImageSourceTypeS3 ImageSourceType = "s3"
+
+	// DefaultS3Region is the region used when a source doesn't specify one.
+	DefaultS3Region = "us-east-1"
+	// s3FocalpointHeader is the header of the focalpoint user metadata of S3
+	// objects.
+	s3FocalpointHeader = "X-Amz-Meta-Focalpoint"
 )
 
 type S3ImageSource struct {
-	Config *SourceConfig
-	Logger *Logger
+	Config      *SourceConfig
+	Logger      *Logger
+	Endpoint    *url.URL
+	Credentials AWSCredentialsProvider
+	Client      *HTTPClient
 }
 
 func NewS3ImageSourceWithConfig(config *SourceConfig) ImageSource {
-	return &S3ImageSource{
-		Config: config,
-		Logger: NewLogger("source.s3.%s", config.Name),
+	source := &S3ImageSource{
+		Config:      config,
+		Logger:      NewLogger("source.s3.%s", config.Name),
+		Credentials: NewAWSCredentialsProviderWithConfig(config),
+		Client:      HTTPClientForConfig(config),
+	}
+
+	endpoint := config.S3Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", config.S3Region)
+	} else if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
 	}
+
+	var err error
+	source.Endpoint, err = url.Parse(endpoint)
+	if err != nil || source.Endpoint.Host == "" {
+		fmt.Fprintf(os.Stderr, "Invalid S3 endpoint %s for source %s\n", config.S3Endpoint, config.Name)
+		os.Exit(1)
+	}
+
+	return source
 }
 
 func (s *S3ImageSource) GetImage(request *ImageSourceOptions) (*Image, error) {
-	httpRequest := s.signedHTTPRequestForRequest(request)
-	httpResponse, err := http.DefaultClient.Do(httpRequest)
-	defer httpResponse.Body.Close()
+	httpRequest, err := s.signedHTTPRequestForRequest(request)
+	if err != nil {
+		s.Logger.Errorf("Error signing request: %v", err)
+		return nil, NewImageError(ErrorKindInternal, err, "Unable to sign request")
+	}
+	httpResponse, err := s.Client.Do(httpRequest)
 	if err != nil {
 		s.Logger.Warnf("Error downlading image: %v", err)
-		return nil, err
+		return nil, imageErrorForRequestError(err)
 	}
+	defer httpResponse.Body.Close()
 	if httpResponse.StatusCode != 200 {
-		return nil, fmt.Errorf("Error downlading image (url=%v)", httpRequest.URL)
+		s.Logger.Warnf("Error downlading image (url=%v, status=%d)", httpRequest.URL, httpResponse.StatusCode)
+		return nil, imageErrorForStatusCode(httpResponse.StatusCode)
+	}
+	data, err := ReadSourceImage(s.Config, httpResponse.Body,
+		httpResponse.ContentLength, httpResponse.Header.Get("Content-Type"))
+	if err != nil {
+		s.Logger.Warnf("Unable to read response body: %v (url=%v)", err, httpRequest.URL)
+		return nil, err
 	}
-	image, err := NewImageFromBuffer(httpResponse.Body)
+	image, err := NewImageFromBytes(data, request.Limits)
 	if err != nil {
-		responseBody, _ := ioutil.ReadAll(httpResponse.Body)
-		s.Logger.Warnf("Unable to create image from response body: %v (url=%v)", string(responseBody), httpRequest.URL)
+		s.Logger.Warnf("Unable to create image from response body: %v (url=%v)", err, httpRequest.URL)
 		return nil, err
 	}
+	image.Metadata = s.imageMetadataForResponse(httpResponse)
 	s.Logger.Infof("Successfully retrieved image from S3: %v", httpRequest.URL)
 	return image, nil
 }
 
-func (s *S3ImageSource) signedHTTPRequestForRequest(request *ImageSourceOptions) *http.Request {
-	path := s.Config.Directory + request.Path
-	imageURLPathComponents := strings.Split(path, "/")
+func (s *S3ImageSource) imageMetadataForResponse(httpResponse *http.Response) ImageMetadata {
+	metadata := NewImageMetadataFromHeader(httpResponse.Header)
+	if s.Config.FocalpointMetadata {
+		metadata.Focalpoint = focalpointForHeader(httpResponse.Header, s3FocalpointHeader, s.Logger)
+	}
+	return metadata
+}
+
+func (s *S3ImageSource) signedHTTPRequestForRequest(request *ImageSourceOptions) (
+	*http.Request, error) {
 
-	for index, component := range imageURLPathComponents {
-		component = url.QueryEscape(component)
-		imageURLPathComponents[index] = component
+	credentials, err := s.Credentials.Retrieve()
+	if err != nil {
+		return nil, err
+	}
+
+	path := s.Config.Directory + request.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	host := s.Endpoint.Host
+	if s.Config.S3PathStyle {
+		path = "/" + s.Config.S3Bucket + path
+	} else {
+		host = s.Config.S3Bucket + "." + host
 	}
+
+	// The path is sent exactly as it's escaped for signing.
 	requestURL := &url.URL{
-		Opaque: strings.Join(imageURLPathComponents, "/"),
-		Scheme: "http",
-		Host:   fmt.Sprintf("%s.s3.amazonaws.com", s.Config.S3Bucket),
+		Scheme:  s.Endpoint.Scheme,
+		Host:    host,
+		Path:    path,
+		RawPath: awsURIEscape(path, false),
 	}
 
-	httpRequest, _ := http.NewRequest("GET", requestURL.RequestURI(), nil)
-	httpRequest.URL = requestURL
-	httpRequest.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
-	s3.Sign(httpRequest, s3.Keys{
-		AccessKey: s.Config.S3AccessKey,
-		SecretKey: s.Config.S3SecretKey,
-	})
+	httpRequest, _ := http.NewRequest("GET", requestURL.String(), nil)
+	signAWSRequestV4(httpRequest, credentials, s.Config.S3Region, "s3", time.Now())
 
-	return httpRequest
+	return httpRequest, nil
 }
 
 func init() {
@@ -30,6 +30,7 @@ import (
 
 type Statter interface {
 	RegisterRequest(*ResponseWriter, *Request)
+	Increment(stat string)
 }
 
 type statsdStatter struct {
@@ -42,7 +43,12 @@ type statsdStatter struct {
 }
 
 func NewStatterWithConfig(routeConfig *RouteConfig, statterConfig *StatterConfig) Statter {
-	logger := NewLogger("stats.%s", routeConfig.Name)
+	return newStatsdStatter(routeConfig.Name, statterConfig)
+}
+
+// newStatsdStatter returns a Statter reporting stats prefixed with name.
+func newStatsdStatter(name string, statterConfig *StatterConfig) Statter {
+	logger := NewLogger("stats.%s", name)
 	hostname, _ := os.Hostname()
 
 	addr, err := net.ResolveUDPAddr(
@@ -61,7 +67,7 @@ func NewStatterWithConfig(routeConfig *RouteConfig, statterConfig *StatterConfig
 	return &statsdStatter{
 		conn:     conn,
 		addr:     addr,
-		Name:     routeConfig.Name,
+		Name:     name,
 		Hostname: hostname,
 		Logger:   logger,
 		Enabled:  statterConfig.Enabled,
@@ -76,7 +82,11 @@ func (s *statsdStatter) RegisterRequest(w *ResponseWriter, r *Request) {
 	now := time.Now()
 
 	status := "success"
-	if w.Status != http.StatusOK {
+	switch w.Status {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		status = "not_modified"
+	default:
 		status = "failure"
 	}
 
@@ -91,6 +101,14 @@ func (s *statsdStatter) RegisterRequest(w *ResponseWriter, r *Request) {
 	}
 }
 
+// Increment increments the counter for the given stat.
+func (s *statsdStatter) Increment(stat string) {
+	if !s.Enabled {
+		return
+	}
+	s.count(stat)
+}
+
 func (s *statsdStatter) count(stat string) {
 	stat = fmt.Sprintf("%s.halfshell.%s.%s", s.Hostname, s.Name, stat)
 	s.Logger.Infof("Incrementing counter: %s", stat)
@@ -40,5 +40,6 @@ StatsD settings:
 Routes:
 {{ range $index, $route := .Routes }}  {{ $route.Name }}:
     Pattern: {{ $route.Pattern }}
-{{ end }}
+{{ if $route.Host }}    Host: {{ $route.Host }}
+{{ end }}{{ end }}
 `